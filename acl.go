@@ -0,0 +1,30 @@
+package consul
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// TokenSelf returns the ACL token the client uses, to log which token and
+// policies apply when ACLs block a read. On a cluster without ACLs it
+// returns ErrFeatureUnavailable.
+func (c *client) TokenSelf() (*consulapi.ACLToken, error) {
+	return c.TokenSelfContext(context.Background())
+}
+
+// TokenSelfContext is TokenSelf cancelled when ctx is done
+func (c *client) TokenSelfContext(ctx context.Context) (*consulapi.ACLToken, error) {
+	token, _, err := c.acl.TokenReadSelf((&consulapi.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		var statusErr consulapi.StatusError
+		if errors.As(err, &statusErr) && strings.Contains(statusErr.Body, "ACL support disabled") {
+			return nil, fmt.Errorf("%w: %w", ErrFeatureUnavailable, err)
+		}
+		return nil, err
+	}
+	return token, nil
+}
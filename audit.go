@@ -0,0 +1,57 @@
+package consul
+
+import (
+	"context"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// AuditHook is called after each successful Put, Delete, Update and
+// SwapValues, op is "put" or "delete" and value is empty for deletes
+type AuditHook func(op, key, value, actor string)
+
+type actorKey struct{}
+
+// WithActor returns a copy of ctx carrying the actor reported to the
+// AuditHook by PutContext, DeleteContext, UpdateContext and
+// SwapValuesContext
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+func actorFrom(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// WithAuditHook sets the hook called after each successful write
+func WithAuditHook(hook AuditHook) Option {
+	return func(c *client) {
+		c.audit = hook
+	}
+}
+
+// PutContext put KVPair, the actor set with WithActor is passed to the AuditHook
+func (c *client) PutContext(ctx context.Context, key string, value string) (*consulapi.WriteMeta, error) {
+	p := &consulapi.KVPair{Key: key, Value: []byte(value)}
+	meta, err := c.kv.Put(p, (&consulapi.WriteOptions{}).WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if c.audit != nil {
+		c.audit("put", key, value, actorFrom(ctx))
+	}
+	return meta, nil
+}
+
+// DeleteContext delete KVPair, the actor set with WithActor is passed to the AuditHook
+func (c *client) DeleteContext(ctx context.Context, key string) (*consulapi.WriteMeta, error) {
+	meta, err := c.kv.Delete(key, (&consulapi.WriteOptions{}).WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if c.audit != nil {
+		c.audit("delete", key, "", actorFrom(ctx))
+	}
+	return meta, nil
+}
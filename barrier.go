@@ -0,0 +1,91 @@
+package consul
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"strings"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// barrierReleased the key under the barrier prefix released once all
+// workers are present, so workers leaving do not hold back slower ones
+const barrierReleased = ".released"
+
+// Barrier puts a presence key of the worker under prefix and blocks until n
+// workers are present or ctx is done. The presence key is deleted on
+// return, and the released marker by the last worker leaving. A prefix must
+// not be reused until all workers of the previous round returned.
+func (c *client) Barrier(ctx context.Context, prefix string, n int) error {
+	prefix = strings.TrimSuffix(prefix, "/") + "/"
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	self := prefix + hex.EncodeToString(id)
+
+	wo := (&consulapi.WriteOptions{}).WithContext(ctx)
+	if _, err := c.kv.Put(&consulapi.KVPair{Key: self}, wo); err != nil {
+		return err
+	}
+	defer c.leaveBarrier(prefix, self)
+
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var passed, released bool
+	check := func(pairs consulapi.KVPairs) {
+		present := 0
+		for _, p := range pairs {
+			if p.Key == prefix+barrierReleased {
+				released = true
+			} else {
+				present++
+			}
+		}
+		if released || present >= n {
+			passed = true
+			cancel()
+		}
+	}
+
+	pairs, meta, err := c.kv.List(prefix, (&consulapi.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return leaderError(err)
+	}
+	check(pairs)
+	if !passed {
+		err = c.watchPrefix(wctx, prefix, meta.LastIndex, check)
+	}
+	if !passed {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	if !released {
+		if _, err := c.kv.Put(&consulapi.KVPair{Key: prefix + barrierReleased}, wo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// leaveBarrier deletes the presence key self, and the released marker when
+// no worker is left
+func (c *client) leaveBarrier(prefix, self string) {
+	if _, err := c.kv.Delete(self, nil); err != nil {
+		return
+	}
+	keys, _, err := c.kv.Keys(prefix, "", nil)
+	if err != nil {
+		return
+	}
+	for _, k := range keys {
+		if k != prefix+barrierReleased {
+			return
+		}
+	}
+	c.kv.Delete(prefix+barrierReleased, nil)
+}
@@ -0,0 +1,43 @@
+package consul
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// ErrNoCipher a struct field is tagged encrypted but the client has no
+// cipher, see WithCipher
+var ErrNoCipher = errors.New("no cipher")
+
+// Cipher encrypts and decrypts the values of struct fields tagged
+// `consul:"encrypted:true"`
+type Cipher interface {
+	Encrypt(plaintext []byte) ([]byte, error)
+	Decrypt(ciphertext []byte) ([]byte, error)
+}
+
+// WithCipher sets the cipher of the struct fields tagged encrypted, their
+// KV values are decrypted on load and encrypted on write
+func WithCipher(cipher Cipher) Option {
+	return func(c *client) {
+		c.cipher = cipher
+	}
+}
+
+// encrypted reports whether the field of tagOptions is tagged encrypted,
+// failing with ErrNoCipher when the client has no cipher for it
+func (c *client) encrypted(tagOptions map[string]string, errPath string) (bool, error) {
+	v, ok := tagOptions["encrypted"]
+	if !ok {
+		return false, nil
+	}
+	enc, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%w: encrypted of \"%s\": %w", ErrInvalidTagOptions, errPath, err)
+	}
+	if enc && c.cipher == nil {
+		return false, fmt.Errorf("%w: field \"%s\" is encrypted", ErrNoCipher, errPath)
+	}
+	return enc, nil
+}
@@ -0,0 +1,112 @@
+package consul
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// Snapshot the KVPairs under a ConfigStore prefix at a version, the
+// version is incremented on every change
+type Snapshot struct {
+	Version uint64
+	Pairs   consulapi.KVPairs
+}
+
+// ConfigStore watches a prefix and keeps the current Snapshot of it for
+// any number of subscribers
+type ConfigStore struct {
+	mu      sync.Mutex
+	current Snapshot
+	subs    map[<-chan Snapshot]chan Snapshot
+	stopped bool
+}
+
+// NewConfigStore loads the KVPairs under prefix and keeps them up to date
+// until ctx is done or the watch fails, the subscriber channels are closed
+// then
+func NewConfigStore(ctx context.Context, c Client, prefix string) (*ConfigStore, error) {
+	w, ok := c.(treeWatcher)
+	if !ok {
+		return nil, errors.New("client does not support watching config")
+	}
+
+	pairs, meta, err := c.KV().List(prefix, (&consulapi.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return nil, leaderError(err)
+	}
+
+	s := &ConfigStore{
+		current: Snapshot{Version: 1, Pairs: pairs},
+		subs:    make(map[<-chan Snapshot]chan Snapshot),
+	}
+	go func() {
+		defer s.stop()
+		w.watchPrefix(ctx, prefix, meta.LastIndex, s.update)
+	}()
+	return s, nil
+}
+
+// Current returns the current snapshot
+func (s *ConfigStore) Current() Snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.current
+}
+
+// Subscribe returns the current snapshot and a channel receiving the
+// following ones. A subscriber falling behind only receives the latest
+// snapshot, it never blocks the watch. The channel is closed once the watch
+// stops.
+func (s *ConfigStore) Subscribe() (Snapshot, <-chan Snapshot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ch := make(chan Snapshot, 1)
+	if s.stopped {
+		close(ch)
+		return s.current, ch
+	}
+	s.subs[ch] = ch
+	return s.current, ch
+}
+
+// Unsubscribe stops delivering snapshots to updates and closes it
+func (s *ConfigStore) Unsubscribe(updates <-chan Snapshot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if ch, ok := s.subs[updates]; ok {
+		delete(s.subs, updates)
+		close(ch)
+	}
+}
+
+// stop closes the channels of all subscribers once the watch stopped
+func (s *ConfigStore) stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stopped = true
+	for updates, ch := range s.subs {
+		delete(s.subs, updates)
+		close(ch)
+	}
+}
+
+func (s *ConfigStore) update(pairs consulapi.KVPairs) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.current = Snapshot{Version: s.current.Version + 1, Pairs: pairs}
+	for _, ch := range s.subs {
+		// replace a snapshot the subscriber did not receive yet
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- s.current
+	}
+}
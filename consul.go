@@ -1,12 +1,21 @@
 package consul
 
 import (
+	"bytes"
+	"context"
+	"encoding"
+	"encoding/gob"
 	"errors"
 	"fmt"
+	"math/rand"
 	"net"
+	"os"
 	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	consulapi "github.com/hashicorp/consul/api"
@@ -20,119 +29,777 @@ func (e ErrKVNotFound) Error() string {
 	return fmt.Sprintf("kv \"%s\" not found", e.Key)
 }
 
+// ErrFieldParse is returned by LoadStruct when a KV value can not be parsed
+// into its struct field
+type ErrFieldParse struct {
+	Path       string
+	Kind       reflect.Kind
+	Underlying error
+}
+
+func (e ErrFieldParse) Error() string {
+	return fmt.Sprintf("kv \"%s\" parse as %s: %v", e.Path, e.Kind, e.Underlying)
+}
+
+func (e ErrFieldParse) Unwrap() error {
+	return e.Underlying
+}
+
+// ErrInsufficientInstances is returned when less healthy instances of a
+// service than required are available
+type ErrInsufficientInstances struct {
+	Service string
+	Count   int
+	Min     int
+}
+
+func (e ErrInsufficientInstances) Error() string {
+	return fmt.Sprintf("service \"%s\" has %d healthy instances, %d required", e.Service, e.Count, e.Min)
+}
+
+// ErrPartialWrite is returned by PutMulti when a transaction fails after
+// previous ones were committed
+type ErrPartialWrite struct {
+	Written    []string
+	Underlying error
+}
+
+func (e ErrPartialWrite) Error() string {
+	return fmt.Sprintf("partial write of %d keys: %v", len(e.Written), e.Underlying)
+}
+
+func (e ErrPartialWrite) Unwrap() error {
+	return e.Underlying
+}
+
 var (
-	ErrInvalidServiceAddr = errors.New("invalid service address")
-	ErrInvalidPort        = errors.New("invalid port")
-	ErrInvalidTagOptions  = errors.New("invalid tag options")
+	ErrInvalidServiceAddr  = errors.New("invalid service address")
+	ErrInvalidPort         = errors.New("invalid port")
+	ErrInvalidTagOptions   = errors.New("invalid tag options")
+	ErrInvalidCheckOptions = errors.New("invalid check options")
+	ErrFeatureUnavailable  = errors.New("feature unavailable")
+	// ErrNoClusterLeader consul has no leader, e.g. during an election,
+	// the read can be retried
+	ErrNoClusterLeader = errors.New("no cluster leader")
+	// ErrUpdateConflict every check-and-set write of Update conflicted
+	ErrUpdateConflict = errors.New("update conflict")
+	// ErrRegistrationTimeout a registered service did not show up in the
+	// catalog within the WaitForRegistration timeout
+	ErrRegistrationTimeout = errors.New("registration timeout")
+	// ErrUnknownCheckTTL a TTL check to re-register was not registered by
+	// this client, the agent does not report its TTL
+	ErrUnknownCheckTTL = errors.New("unknown check TTL")
 )
 
-var allowOptions = map[string]string{"name": "", "default": ""}
+// leaderError wraps a "No cluster leader" error of consul in ErrNoClusterLeader
+func leaderError(err error) error {
+	var statusErr consulapi.StatusError
+	if errors.As(err, &statusErr) && strings.Contains(statusErr.Body, "No cluster leader") {
+		return fmt.Errorf("%w: %w", ErrNoClusterLeader, err)
+	}
+	return err
+}
 
-//Client provides an interface for getting data out of Consul
+var allowOptions = map[string]string{"name": "", "default": "", "layout": "", "encrypted": "", "size": ""}
+
+// Client provides an interface for getting data out of Consul
 type Client interface {
+	// Raw underlying consul api client
+	Raw() *consulapi.Client
+	// KV underlying consul KV handle
+	KV() *consulapi.KV
+	// Health underlying consul Health handle
+	Health() *consulapi.Health
+	// Agent underlying consul Agent handle
+	Agent() *consulapi.Agent
 	// GetServices get a services from consul
 	GetServices(service string, tag string) ([]*consulapi.ServiceEntry, *consulapi.QueryMeta, error)
+	// GetServicesContext get services cancelled when ctx is done
+	GetServicesContext(ctx context.Context, service string, tag string) ([]*consulapi.ServiceEntry, *consulapi.QueryMeta, error)
 	// GetFirstService get a first service from consul
 	GetFirstService(service string, tag string) (*consulapi.ServiceEntry, *consulapi.QueryMeta, error)
+	// GetFirstServiceContext get a first service from consul cancelled when ctx is done
+	GetFirstServiceContext(ctx context.Context, service string, tag string) (*consulapi.ServiceEntry, *consulapi.QueryMeta, error)
+	// GetFirstLocalService get a service on the local node first
+	GetFirstLocalService(service string, tag string) (*consulapi.ServiceEntry, *consulapi.QueryMeta, error)
+	// GetFirstLocalServiceContext get a service on the local node first cancelled when ctx is done
+	GetFirstLocalServiceContext(ctx context.Context, service string, tag string) (*consulapi.ServiceEntry, *consulapi.QueryMeta, error)
+	// GetWeightedRandomService get a service picked by tag weights
+	GetWeightedRandomService(service string, tagKey string) (*consulapi.ServiceEntry, error)
+	// GetWeightedRandomServiceContext get a service picked by tag weights cancelled when ctx is done
+	GetWeightedRandomServiceContext(ctx context.Context, service string, tagKey string) (*consulapi.ServiceEntry, error)
+	// GetServiceAddresses get host:port of each service
+	GetServiceAddresses(service string, tag string) ([]string, error)
+	// GetServiceAddressesContext get host:port of each service cancelled when ctx is done
+	GetServiceAddressesContext(ctx context.Context, service string, tag string) ([]string, error)
+	// GetServiceAddressesMin get host:port of each service if at least min
+	GetServiceAddressesMin(service string, tag string, min int) ([]string, error)
+	// GetServiceAddressesMinContext get host:port of each service if at least min cancelled when ctx is done
+	GetServiceAddressesMinContext(ctx context.Context, service string, tag string, min int) ([]string, error)
+	// GetServiceTaggedAddress get the tagged address of each service
+	GetServiceTaggedAddress(service string, tag string, addrTag string) ([]string, error)
+	// GetServiceTaggedAddressContext get the tagged address of each service cancelled when ctx is done
+	GetServiceTaggedAddressContext(ctx context.Context, service string, tag string, addrTag string) ([]string, error)
+	// GetServicesAtIndex get several services with the max index observed
+	GetServicesAtIndex(services []string, tag string) (map[string][]*consulapi.ServiceEntry, uint64, error)
+	// GetServicesAtIndexContext get several services with the max index observed cancelled when ctx is done
+	GetServicesAtIndexContext(ctx context.Context, services []string, tag string) (map[string][]*consulapi.ServiceEntry, uint64, error)
+	// WatchServices watch passing services
+	WatchServices(ctx context.Context, service string, tag string) <-chan []*consulapi.ServiceEntry
+	// WatchServicesFiltered watch passing services matching filter
+	WatchServicesFiltered(ctx context.Context, service string, tag string, filter string) <-chan []*consulapi.ServiceEntry
+	// GetServicesWithFallback get services or a static list when discovery fails
+	GetServicesWithFallback(service, tag string, fallback []string) ([]*consulapi.ServiceEntry, error)
+	// GetServicesWithFallbackContext get services or a static list when discovery fails cancelled when ctx is done
+	GetServicesWithFallbackContext(ctx context.Context, service, tag string, fallback []string) ([]*consulapi.ServiceEntry, error)
+	// GetActiveColorService get services tagged with the active color read from KV
+	GetActiveColorService(service, colorKey string) ([]*consulapi.ServiceEntry, error)
+	// GetActiveColorServiceContext get services tagged with the active color read from KV cancelled when ctx is done
+	GetActiveColorServiceContext(ctx context.Context, service, colorKey string) ([]*consulapi.ServiceEntry, error)
+	// Resolver resolve a service to its passing instances kept up to date
+	Resolver(service, tag string) *ServiceResolver
+	// ResolverContext resolve a service to its passing instances kept up to date until ctx is done
+	ResolverContext(ctx context.Context, service, tag string) *ServiceResolver
+	// ServiceTags get the union of the tags of all instances of a service
+	ServiceTags(service string) ([]string, error)
+	// ServiceTagsContext get the union of the tags of all instances of a service cancelled when ctx is done
+	ServiceTagsContext(ctx context.Context, service string) ([]string, error)
+	// WatchServiceTags watch the tags of each instance of a service
+	WatchServiceTags(ctx context.Context, service string) <-chan map[string][]string
+	// WaitForServices wait for a passing service
+	WaitForServices(ctx context.Context, service string, tag string) ([]*consulapi.ServiceEntry, error)
+	// WaitForServicesOpts wait for services matching options
+	WaitForServicesOpts(ctx context.Context, service string, opts WaitOptions) ([]*consulapi.ServiceEntry, error)
 	// RegisterService register a service with local agent
 	RegisterService(name string, addr string, tags ...string) error
+	// RegisterServiceContext register a service with local agent cancelled when ctx is done
+	RegisterServiceContext(ctx context.Context, name string, addr string, tags ...string) error
+	// RegisterServiceWithOptions register a service with local agent
+	RegisterServiceWithOptions(opts ServiceOptions) error
+	// RegisterServiceWithOptionsContext register a service with local agent cancelled when ctx is done
+	RegisterServiceWithOptionsContext(ctx context.Context, opts ServiceOptions) error
+	// RegisterHTTPService register service with an HTTP check on its address
+	RegisterHTTPService(name, addr, healthPath string, interval time.Duration, tags ...string) error
+	// RegisterHTTPServiceContext register service with an HTTP check on its address cancelled when ctx is done
+	RegisterHTTPServiceContext(ctx context.Context, name, addr, healthPath string, interval time.Duration, tags ...string) error
+	// RegisterConnectService register a service with a sidecar proxy
+	RegisterConnectService(name string, addr string, upstreams []Upstream, tags ...string) error
+	// RegisterConnectServiceContext register a service with a sidecar proxy cancelled when ctx is done
+	RegisterConnectServiceContext(ctx context.Context, name string, addr string, upstreams []Upstream, tags ...string) error
+	// PassTTL mark a TTL check as passing
+	PassTTL(checkID string, note string) error
+	// PassTTLContext mark a TTL check as passing cancelled when ctx is done
+	PassTTLContext(ctx context.Context, checkID string, note string) error
+	// UpdateServiceTags replace the tags of a registered service
+	UpdateServiceTags(serviceID string, tags []string) error
+	// UpdateServiceTagsContext replace the tags of a registered service cancelled when ctx is done
+	UpdateServiceTagsContext(ctx context.Context, serviceID string, tags []string) error
+	// RegisterServiceWithHeartbeat register a service whose TTL check is passed by Heartbeats
+	RegisterServiceWithHeartbeat(opts ServiceOptions) error
+	// RegisterServiceWithHeartbeatContext register a service whose TTL check is passed by Heartbeats cancelled when ctx is done
+	RegisterServiceWithHeartbeatContext(ctx context.Context, opts ServiceOptions) error
+	// Heartbeats get the manager passing TTL checks from a single goroutine
+	Heartbeats() *HeartbeatManager
+	// RegisterServiceForListener register a service at the address of a listener
+	RegisterServiceForListener(name string, ln net.Listener, tags ...string) error
+	// RegisterServiceForListenerContext register a service at the address of a listener cancelled when ctx is done
+	RegisterServiceForListenerContext(ctx context.Context, name string, ln net.Listener, tags ...string) error
+	// ExportServices get the services registered with local agent and their checks as JSON
+	ExportServices() ([]byte, error)
+	// ExportServicesContext get the services registered with local agent and their checks as JSON cancelled when ctx is done
+	ExportServicesContext(ctx context.Context) ([]byte, error)
+	// ImportServices register the services exported by ExportServices
+	ImportServices(data []byte) error
+	// ImportServicesContext register the services exported by ExportServices cancelled when ctx is done
+	ImportServicesContext(ctx context.Context, data []byte) error
+	// StopHeartbeat stop passing the TTL check of a service
+	StopHeartbeat(id string)
 	// DeRegisterService deregister a service with local agent
 	DeRegisterService(string) error
+	// DeRegisterServiceContext deregister a service with local agent cancelled when ctx is done
+	DeRegisterServiceContext(ctx context.Context, id string) error
+	// DrainAndDeregister remove a service from discovery and deregister it after a grace period
+	DrainAndDeregister(ctx context.Context, serviceID string, grace time.Duration) error
+	// DeRegisterAllOwn deregister all services registered by this client
+	DeRegisterAllOwn() error
+	// DeRegisterAllOwnContext deregister all services registered by this client cancelled when ctx is done
+	DeRegisterAllOwnContext(ctx context.Context) error
 	// Get get KVPair
 	Get(key string) (*consulapi.KVPair, *consulapi.QueryMeta, error)
+	// GetContext get KVPair cancelled when ctx is done
+	GetContext(ctx context.Context, key string) (*consulapi.KVPair, *consulapi.QueryMeta, error)
+	// GetStaleIfError get KVPair, serving the last value on error
+	GetStaleIfError(key string) (*consulapi.KVPair, bool, error)
+	// GetStaleIfErrorContext get KVPair, serving the last value on error, cancelled when ctx is done
+	GetStaleIfErrorContext(ctx context.Context, key string) (*consulapi.KVPair, bool, error)
+	// GetEventual get KVPair retrying while not found
+	GetEventual(key string, attempts int, delay time.Duration) (*consulapi.KVPair, *consulapi.QueryMeta, error)
+	// GetEventualContext get KVPair retrying while not found cancelled when ctx is done
+	GetEventualContext(ctx context.Context, key string, attempts int, delay time.Duration) (*consulapi.KVPair, *consulapi.QueryMeta, error)
 	// WatchGet
 	WatchGet(key string) chan *consulapi.KVPair
+	// WatchGetContext watch KVPair until ctx is done
+	WatchGetContext(ctx context.Context, key string) <-chan *consulapi.KVPair
+	// WatchTemplate render a template of KVPairs again whenever they change
+	WatchTemplate(ctx context.Context, tmpl string, out func(rendered string)) error
+	// MirrorToFile write a KVPair value to a file on every change
+	MirrorToFile(ctx context.Context, key, path string, mode os.FileMode) error
+	// WatchTree watch KVPairs under prefix
+	WatchTree(prefix string) chan consulapi.KVPairs
+	// WatchTreeContext watch KVPairs under prefix until ctx is done
+	WatchTreeContext(ctx context.Context, prefix string) <-chan consulapi.KVPairs
+	// WatchTreeBatched watch KVPairs under prefix delivering changes in batches
+	WatchTreeBatched(ctx context.Context, prefix string, window time.Duration) <-chan []*consulapi.KVPair
+	// WatchTreeDiff get KVPairs under prefix and watch the differences of each change
+	WatchTreeDiff(ctx context.Context, prefix string) (consulapi.KVPairs, <-chan TreeDiff, error)
+	// WatchTreeEvents watch KVPairs under prefix emitting an event per changed key
+	WatchTreeEvents(ctx context.Context, prefix string, opts WatchTreeOptions) <-chan TreeEvent
+	// WatchStructMap watch structs under each child prefix of parent
+	WatchStructMap(ctx context.Context, parent string, factory func() interface{}) (<-chan map[string]interface{}, error)
+	// WatchGetStoppable watch KVPair until stop is called
+	WatchGetStoppable(key string) (<-chan *consulapi.KVPair, func())
+	// WatchGetEvents watch KVPair changes along with the query index
+	WatchGetEvents(key string) <-chan KVEvent
+	// WatchGetEventsContext watch KVPair changes along with the query index until ctx is done
+	WatchGetEventsContext(ctx context.Context, key string) <-chan KVEvent
+	// SwapValues atomically swap the values of two keys
+	SwapValues(keyA, keyB string) error
+	// SwapValuesContext atomically swap the values of two keys cancelled when ctx is done
+	SwapValuesContext(ctx context.Context, keyA, keyB string) error
+	// Stat get KVPair metadata
+	Stat(key string) (*KVStat, error)
+	// StatContext get KVPair metadata cancelled when ctx is done
+	StatContext(ctx context.Context, key string) (*KVStat, error)
 	// GetStr get string value
 	GetStr(key string) (string, error)
+	// GetStrContext get string value cancelled when ctx is done
+	GetStrContext(ctx context.Context, key string) (string, error)
+	// GetBytesSize get byte size value with a unit suffix
+	GetBytesSize(key string) (int64, error)
+	// GetBytesSizeContext get byte size value with a unit suffix cancelled when ctx is done
+	GetBytesSizeContext(ctx context.Context, key string) (int64, error)
+	// GetStrChain get string value of key under the first prefix having it
+	GetStrChain(key string, prefixes ...string) (string, error)
+	// GetStrChainContext get string value of key under the first prefix having it cancelled when ctx is done
+	GetStrChainContext(ctx context.Context, key string, prefixes ...string) (string, error)
+	// GetStrAuto get string value, decompressing gzip values
+	GetStrAuto(key string) (string, error)
+	// GetStrAutoContext get string value, decompressing gzip values, cancelled when ctx is done
+	GetStrAutoContext(ctx context.Context, key string) (string, error)
+	// GetWithSession get string value and the session holding the key
+	GetWithSession(key string) (string, string, error)
+	// GetWithSessionContext get string value and the session holding the key cancelled when ctx is done
+	GetWithSessionContext(ctx context.Context, key string) (string, string, error)
 	// GetInt get string value
 	GetInt(key string) (int, error)
+	// GetIntContext get int value cancelled when ctx is done
+	GetIntContext(ctx context.Context, key string) (int, error)
+	// GetIntOrDefault get int value or def when missing or blank
+	GetIntOrDefault(key string, def int) (int, error)
+	// GetIntOrDefaultContext get int value or def when missing or blank cancelled when ctx is done
+	GetIntOrDefaultContext(ctx context.Context, key string, def int) (int, error)
+	// GetBool get bool value
+	GetBool(key string) (bool, error)
+	// GetBoolContext get bool value cancelled when ctx is done
+	GetBoolContext(ctx context.Context, key string) (bool, error)
 	// Put put KVPair
 	Put(key string, value string) (*consulapi.WriteMeta, error)
+	// Delete delete KVPair
+	Delete(key string) (*consulapi.WriteMeta, error)
+	// Update read-modify-write KVPair with check-and-set
+	Update(key string, fn func(old string) (string, error)) (string, error)
+	// UpdateContext read-modify-write KVPair with check-and-set cancelled when ctx is done
+	UpdateContext(ctx context.Context, key string, fn func(old string) (string, error)) (string, error)
+	// PutContext put KVPair reporting the actor of ctx to the AuditHook
+	PutContext(ctx context.Context, key string, value string) (*consulapi.WriteMeta, error)
+	// DeleteContext delete KVPair reporting the actor of ctx to the AuditHook
+	DeleteContext(ctx context.Context, key string) (*consulapi.WriteMeta, error)
+	// PutMulti put several KVPairs in transactions
+	PutMulti(pairs map[string]string) (*consulapi.WriteMeta, error)
+	// PutMultiContext put several KVPairs in transactions cancelled when ctx is done
+	PutMultiContext(ctx context.Context, pairs map[string]string) (*consulapi.WriteMeta, error)
+	// PutGob put a gob encoded value
+	PutGob(key string, v interface{}) error
+	// PutGobContext put a gob encoded value cancelled when ctx is done
+	PutGobContext(ctx context.Context, key string, v interface{}) error
+	// GetGob get a gob encoded value
+	GetGob(key string, v interface{}) error
+	// GetGobContext get a gob encoded value cancelled when ctx is done
+	GetGobContext(ctx context.Context, key string, v interface{}) error
+	// TreeChecksum checksum of all KVPairs under prefix
+	TreeChecksum(prefix string) (string, error)
+	// TreeChecksumContext checksum of all KVPairs under prefix cancelled when ctx is done
+	TreeChecksumContext(ctx context.Context, prefix string) (string, error)
+	// TokenSelf get the ACL token used by the client
+	TokenSelf() (*consulapi.ACLToken, error)
+	// TokenSelfContext get the ACL token used by the client cancelled when ctx is done
+	TokenSelfContext(ctx context.Context) (*consulapi.ACLToken, error)
+	// WatchLeader watch the cluster leader address
+	WatchLeader(ctx context.Context) <-chan string
+	// Barrier block until n workers are present under prefix
+	Barrier(ctx context.Context, prefix string, n int) error
+	// Lock acquire a distributed lock on key
+	Lock(key string, opts ...LockOption) (*Lock, error)
+	// SessionKeepAlive create a session renewed until ctx is done
+	SessionKeepAlive(ctx context.Context, ttl time.Duration) (string, <-chan struct{}, error)
+	// ListSessions list all sessions
+	ListSessions() ([]*consulapi.SessionEntry, error)
+	// ListSessionsContext list all sessions cancelled when ctx is done
+	ListSessionsContext(ctx context.Context) ([]*consulapi.SessionEntry, error)
+	// DestroyOrphanedSessions destroy sessions left by other processes
+	DestroyOrphanedSessions(olderThan time.Duration) (int, error)
+	// DestroyOrphanedSessionsContext destroy sessions left by other processes cancelled when ctx is done
+	DestroyOrphanedSessionsContext(ctx context.Context, olderThan time.Duration) (int, error)
+	// ListSince list KVPairs under prefix modified after sinceIndex
+	ListSince(prefix string, sinceIndex uint64) (consulapi.KVPairs, uint64, error)
+	// ListSinceContext list KVPairs under prefix modified after sinceIndex cancelled when ctx is done
+	ListSinceContext(ctx context.Context, prefix string, sinceIndex uint64) (consulapi.KVPairs, uint64, error)
+	// ListWithFilterNote list KVPairs under prefix noting ACL filtering
+	ListWithFilterNote(prefix string) (consulapi.KVPairs, bool, error)
+	// ListWithFilterNoteContext list KVPairs under prefix noting ACL filtering cancelled when ctx is done
+	ListWithFilterNoteContext(ctx context.Context, prefix string) (consulapi.KVPairs, bool, error)
 	// Load struct
 	LoadStruct(parent string, i interface{}) error
+	// LoadStructContext load struct cancelled when ctx is done
+	LoadStructContext(ctx context.Context, parent string, i interface{}) error
+	// CachedLoadStruct load struct served from a cache for ttl
+	CachedLoadStruct(parent string, i interface{}, ttl time.Duration) error
+	// CachedLoadStructContext load struct served from a cache for ttl cancelled when ctx is done
+	CachedLoadStructContext(ctx context.Context, parent string, i interface{}, ttl time.Duration) error
+	// SaveStruct write struct fields to KVPairs under parent
+	SaveStruct(parent string, i interface{}) error
+	// SaveStructContext write struct fields to KVPairs under parent cancelled when ctx is done
+	SaveStructContext(ctx context.Context, parent string, i interface{}) error
+	// DiffStruct diff KVPairs under parent against a struct
+	DiffStruct(parent string, desired interface{}) ([]string, error)
+	// DiffStructContext diff KVPairs under parent against a struct cancelled when ctx is done
+	DiffStructContext(ctx context.Context, parent string, desired interface{}) ([]string, error)
+	// ReconcileStruct write the fields of a struct differing from KVPairs under parent
+	ReconcileStruct(parent string, desired interface{}) ([]string, error)
+	// ReconcileStructContext write the fields of a struct differing from KVPairs under parent cancelled when ctx is done
+	ReconcileStructContext(ctx context.Context, parent string, desired interface{}) ([]string, error)
+	// LoadStructReport load struct reporting the source of each field
+	LoadStructReport(parent string, i interface{}) (LoadReport, error)
+	// LoadStructReportContext load struct reporting the source of each field cancelled when ctx is done
+	LoadStructReportContext(ctx context.Context, parent string, i interface{}) (LoadReport, error)
+	// LoadStructProfile load struct from basePrefix/default overlaid by basePrefix/profile
+	LoadStructProfile(basePrefix, profile string, i interface{}) error
+	// LoadStructProfileContext load struct from basePrefix/default overlaid by basePrefix/profile cancelled when ctx is done
+	LoadStructProfileContext(ctx context.Context, basePrefix, profile string, i interface{}) error
+	// LoadStructs load several structs concurrently
+	LoadStructs(specs map[string]interface{}) error
+	// LoadStructsContext load several structs concurrently cancelled when ctx is done
+	LoadStructsContext(ctx context.Context, specs map[string]interface{}) error
+	// LoadStructWithFailover load struct from the first datacenter having parent
+	LoadStructWithFailover(parent string, dcs []string, i interface{}) error
+	// LoadStructWithFailoverContext load struct from the first datacenter having parent cancelled when ctx is done
+	LoadStructWithFailoverContext(ctx context.Context, parent string, dcs []string, i interface{}) error
+	// LoadStructWithOptions load struct with options
+	LoadStructWithOptions(parent string, i interface{}, opts LoadOptions) error
+	// LoadStructWithOptionsContext load struct with options cancelled when ctx is done
+	LoadStructWithOptionsContext(ctx context.Context, parent string, i interface{}, opts LoadOptions) error
+	// WatchStruct load struct and reload it on change
+	WatchStruct(parent string, i interface{}, mu sync.Locker) (<-chan struct{}, error)
+	// WatchStructContext load struct and reload it on change until ctx is done
+	WatchStructContext(ctx context.Context, parent string, i interface{}, mu sync.Locker) (<-chan struct{}, error)
+	// WatchStructDebounced load struct and reload it once changes settle
+	WatchStructDebounced(parent string, i interface{}, mu sync.Locker, window time.Duration) (<-chan struct{}, error)
+	// WatchStructDebouncedContext load struct and reload it once changes settle until ctx is done
+	WatchStructDebouncedContext(ctx context.Context, parent string, i interface{}, mu sync.Locker, window time.Duration) (<-chan struct{}, error)
 }
 
 type client struct {
-	kv     *consulapi.KV
-	health *consulapi.Health
-	meta   map[string]*consulapi.QueryMeta
-	agent  *consulapi.Agent
+	raw     *consulapi.Client
+	kv      *consulapi.KV
+	health  *consulapi.Health
+	meta    *metaCache
+	agent   *consulapi.Agent
+	session *consulapi.Session
+	txn     *consulapi.Txn
+	status  *consulapi.Status
+	acl     *consulapi.ACL
+
+	ownMu sync.Mutex
+	// own the check definitions by check ID of the services registered by
+	// this client, by service ID. The agent does not report the TTL and
+	// thresholds of a check, re-registrations take them from here.
+	own map[string]map[string]*consulapi.AgentServiceCheck
+	// heartbeated the checks passed by heartbeats by service ID
+	heartbeated map[string]string
+	heartbeats  *HeartbeatManager
+
+	sessionsMu sync.Mutex
+	sessions   map[string]struct{}
+
+	metaCacheSize  int
+	permissiveBool bool
+	strictTags     bool
+	onWatchIndex   func(key string, oldIndex, newIndex uint64)
+	onDiscovery    func(service string, count int, d time.Duration, err error)
+	audit          AuditHook
+	cipher         Cipher
+
+	leaderPollInterval time.Duration
+	watchMaxLifetime   time.Duration
+	consistentWatches  bool
+	registrationWait   time.Duration
+
+	structCacheMu sync.Mutex
+	structCache   map[structCacheKey]cachedStruct
+
+	staleWindow time.Duration
+	staleMu     sync.Mutex
+	stale       map[string]staleEntry
+
+	randMu sync.Mutex
+	rand   *rand.Rand
+}
+
+// Option configures a client
+type Option func(*client)
+
+// WithMetaCacheSize bounds the number of keys whose last index is kept for
+// WatchGet, defaults to 1024. Evicting a key only makes a future watch of it
+// start from the current state instead of the last read.
+func WithMetaCacheSize(size int) Option {
+	return func(c *client) {
+		c.metaCacheSize = size
+	}
+}
+
+// WithWatchIndexHook calls hook after each blocking query cycle of a watch
+// with the watched key (prefix or service name), the index waited for and
+// the index returned, to debug the progression of watches
+func WithWatchIndexHook(hook func(key string, oldIndex, newIndex uint64)) Option {
+	return func(c *client) {
+		c.onWatchIndex = hook
+	}
+}
+
+// WithDiscoveryHook calls hook after each GetServices and GetFirstService
+// with the service, the number of passing instances found, the duration
+// of the query and its error, e.g. to track discovery SLOs
+func WithDiscoveryHook(hook func(service string, count int, d time.Duration, err error)) Option {
+	return func(c *client) {
+		c.onDiscovery = hook
+	}
+}
+
+// WithLeaderPollInterval sets how often WatchLeader polls the leader,
+// defaults to 5s
+func WithLeaderPollInterval(interval time.Duration) Option {
+	return func(c *client) {
+		c.leaderPollInterval = interval
+	}
+}
+
+// WithStaleIfError makes GetStaleIfError serve the last value read
+// successfully for up to window when consul returns an error
+func WithStaleIfError(window time.Duration) Option {
+	return func(c *client) {
+		c.staleWindow = window
+	}
+}
+
+// WithRandSource sets the source of the random service selection,
+// e.g. a fixed seed for tests
+func WithRandSource(src rand.Source) Option {
+	return func(c *client) {
+		c.rand = rand.New(src)
+	}
+}
+
+// WithWatchMaxLifetime makes watches tear down and re-establish their
+// blocking query after lifetime even without a change, to shed queries
+// stuck on half-dead connections the OS has not reaped
+func WithWatchMaxLifetime(lifetime time.Duration) Option {
+	return func(c *client) {
+		c.watchMaxLifetime = lifetime
+	}
+}
+
+// WithConsistentWatches makes the blocking queries of watches read with
+// RequireConsistent, so a watched value never goes back to a stale one
+// during a leader election. Every query is then served by the leader,
+// increasing its load.
+func WithConsistentWatches() Option {
+	return func(c *client) {
+		c.consistentWatches = true
+	}
+}
+
+// WaitForRegistration makes the service registrations block until the
+// instance is visible in the catalog, so an immediate GetServices finds it,
+// returning ErrRegistrationTimeout when it does not show up within timeout
+func WaitForRegistration(timeout time.Duration) Option {
+	return func(c *client) {
+		c.registrationWait = timeout
+	}
+}
+
+// WithPermissiveBool makes bool values also accept yes/no/on/off
+// (case-insensitive) besides the strconv.ParseBool spellings
+func WithPermissiveBool() Option {
+	return func(c *client) {
+		c.permissiveBool = true
+	}
+}
+
+// WithStrictTags makes struct loading fail with ErrInvalidTagOptions on
+// unknown consul tag options, e.g. a misspelled default, which are ignored
+// otherwise
+func WithStrictTags() Option {
+	return func(c *client) {
+		c.strictTags = true
+	}
 }
 
 // NewClient returns a Client interface for given consul address
-func NewClientWithConsulClient(c *consulapi.Client) Client {
-	return &client{
-		kv:     c.KV(),
-		health: c.Health(),
-		agent:  c.Agent(),
-		meta:   make(map[string]*consulapi.QueryMeta),
+func NewClientWithConsulClient(c *consulapi.Client, opts ...Option) Client {
+	cl := &client{
+		raw:         c,
+		kv:          c.KV(),
+		health:      c.Health(),
+		agent:       c.Agent(),
+		session:     c.Session(),
+		txn:         c.Txn(),
+		status:      c.Status(),
+		acl:         c.ACL(),
+		own:         make(map[string]map[string]*consulapi.AgentServiceCheck),
+		heartbeated: make(map[string]string),
+		heartbeats:  newHeartbeatManager(c.Agent()),
+		sessions:    make(map[string]struct{}),
+		stale:       make(map[string]staleEntry),
+		structCache: make(map[structCacheKey]cachedStruct),
+	}
+	for _, opt := range opts {
+		opt(cl)
+	}
+	if cl.rand == nil {
+		cl.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
 	}
+	cl.meta = newMetaCache(cl.metaCacheSize)
+	return cl
 }
 
 // NewClient returns a Client interface for given consul address
-func NewClientWithDefaultConfig() (Client, error) {
-	return NewClient(consulapi.DefaultConfig())
+func NewClientWithDefaultConfig(opts ...Option) (Client, error) {
+	return NewClient(consulapi.DefaultConfig(), opts...)
 }
 
 // NewClient returns a Client interface for given consul address
-func NewClient(config *consulapi.Config) (Client, error) {
+func NewClient(config *consulapi.Config, opts ...Option) (Client, error) {
+	c, err := consulapi.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return NewClientWithConsulClient(c, opts...), nil
+}
+
+// NewClientVerified returns a Client interface for given consul address
+// after checking the agent is reachable, to catch a misconfigured address
+// at startup rather than on first use
+func NewClientVerified(config *consulapi.Config, opts ...Option) (Client, error) {
 	c, err := consulapi.NewClient(config)
 	if err != nil {
 		return nil, err
 	}
-	return NewClientWithConsulClient(c), nil
+	if _, err := c.Status().Leader(); err != nil {
+		return nil, fmt.Errorf("consul agent unreachable: %w", err)
+	}
+	return NewClientWithConsulClient(c, opts...), nil
+}
+
+// Raw returns the underlying consul api client, using it directly bypasses
+// the client options
+func (c *client) Raw() *consulapi.Client {
+	return c.raw
+}
+
+// KV returns the underlying consul KV handle, using it directly bypasses
+// the client options
+func (c *client) KV() *consulapi.KV {
+	return c.kv
+}
+
+// Health returns the underlying consul Health handle, using it directly
+// bypasses the client options
+func (c *client) Health() *consulapi.Health {
+	return c.health
+}
+
+// Agent returns the underlying consul Agent handle, using it directly
+// bypasses the client options and registration tracking
+func (c *client) Agent() *consulapi.Agent {
+	return c.agent
 }
 
 // Get KVPair
 func (c *client) Get(key string) (*consulapi.KVPair, *consulapi.QueryMeta, error) {
-	kv, meta, err := c.kv.Get(key, nil)
+	return c.get(key, nil)
+}
+
+// GetContext is Get cancelled when ctx is done
+func (c *client) GetContext(ctx context.Context, key string) (*consulapi.KVPair, *consulapi.QueryMeta, error) {
+	return c.get(key, (&consulapi.QueryOptions{}).WithContext(ctx))
+}
+
+func (c *client) get(key string, q *consulapi.QueryOptions) (*consulapi.KVPair, *consulapi.QueryMeta, error) {
+	kv, meta, err := c.kv.Get(key, q)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, leaderError(err)
 	}
 	if kv == nil {
 		return nil, nil, ErrKVNotFound{Key: key}
 	}
 
-	c.meta[key] = meta
+	c.meta.set(key, meta)
 
 	return kv, meta, nil
 }
 
+// GetEventual KVPair retrying up to attempts times with delay while the key
+// is not found, e.g. a stale read right after a Put on another server
+func (c *client) GetEventual(key string, attempts int, delay time.Duration) (*consulapi.KVPair, *consulapi.QueryMeta, error) {
+	return c.GetEventualContext(context.Background(), key, attempts, delay)
+}
+
+// GetEventualContext is GetEventual cancelled when ctx is done, including
+// between attempts
+func (c *client) GetEventualContext(ctx context.Context, key string, attempts int, delay time.Duration) (*consulapi.KVPair, *consulapi.QueryMeta, error) {
+	for i := 1; ; i++ {
+		kv, meta, err := c.GetContext(ctx, key)
+		if _, ok := err.(ErrKVNotFound); !ok || i >= attempts {
+			return kv, meta, err
+		}
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
 func (c *client) WatchGet(key string) chan *consulapi.KVPair {
 	doneCh := make(chan *consulapi.KVPair)
 	go func(k string, ch chan *consulapi.KVPair) {
-		for {
-			var lastIndex uint64 = 1
-			if meta, ok := c.meta[key]; ok {
-				lastIndex = meta.LastIndex
-			}
-			kv, meta, err := c.kv.Get(k, &consulapi.QueryOptions{WaitIndex: lastIndex})
+		defer close(ch)
+		c.watchKey(context.Background(), k, func(kv *consulapi.KVPair, index uint64) {
+			ch <- kv
+		})
+	}(key, doneCh)
+	return doneCh
+}
 
-			if lastIndex == 1 && kv == nil {
-				continue
+// WatchGetContext is WatchGet terminated when ctx is done, the channel is
+// closed then
+func (c *client) WatchGetContext(ctx context.Context, key string) <-chan *consulapi.KVPair {
+	ch := make(chan *consulapi.KVPair)
+	go func() {
+		defer close(ch)
+		c.watchKey(ctx, key, func(kv *consulapi.KVPair, index uint64) {
+			select {
+			case ch <- kv:
+			case <-ctx.Done():
 			}
+		})
+	}()
+	return ch
+}
 
-			if err != nil {
-				close(ch)
+// WatchGetStoppable is WatchGet for callers without a context, calling
+// stop terminates the watch and closes the channel
+func (c *client) WatchGetStoppable(key string) (<-chan *consulapi.KVPair, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	return c.WatchGetContext(ctx, key), cancel
+}
+
+// KVEvent a change of a watched key, KV is nil when the key was deleted
+type KVEvent struct {
+	KV *consulapi.KVPair
+	// Index of the query returning the change, to resume the watch from
+	Index uint64
+}
+
+// WatchGetEvents is WatchGet delivering the query index along with the
+// KVPair, so deletions also carry an index
+func (c *client) WatchGetEvents(key string) <-chan KVEvent {
+	return c.WatchGetEventsContext(context.Background(), key)
+}
+
+// WatchGetEventsContext is WatchGetEvents terminated when ctx is done, the
+// channel is closed then
+func (c *client) WatchGetEventsContext(ctx context.Context, key string) <-chan KVEvent {
+	ch := make(chan KVEvent)
+	go func() {
+		defer close(ch)
+		c.watchKey(ctx, key, func(kv *consulapi.KVPair, index uint64) {
+			select {
+			case ch <- KVEvent{KV: kv, Index: index}:
+			case <-ctx.Done():
 			}
-			c.meta[key] = meta
-			ch <- kv
+		})
+	}()
+	return ch
+}
+
+// watchKey calls fn on every change of key until a query fails or ctx is
+// done. Changes before the key first exists are skipped.
+func (c *client) watchKey(ctx context.Context, key string, fn func(kv *consulapi.KVPair, index uint64)) error {
+	var lastIndex uint64
+	if meta, ok := c.meta.get(key); ok {
+		lastIndex = meta.LastIndex
+	}
+	found := lastIndex > 0
+
+	var kv *consulapi.KVPair
+	var meta *consulapi.QueryMeta
+	return c.blockingQuery(ctx, key, lastIndex, func(q *consulapi.QueryOptions) (uint64, error) {
+		var err error
+		kv, meta, err = c.kv.Get(key, q)
+		if err != nil {
+			return 0, err
 		}
-	}(key, doneCh)
-	return doneCh
+		c.meta.set(key, meta)
+		return meta.LastIndex, nil
+	}, func() {
+		if kv == nil && !found {
+			return
+		}
+		found = true
+		fn(kv, meta.LastIndex)
+	})
 }
 
 // GetStr string
 func (c *client) GetStr(key string) (string, error) {
-	kv, _, err := c.Get(key)
+	return c.GetStrContext(context.Background(), key)
+}
+
+// GetStrContext is GetStr cancelled when ctx is done
+func (c *client) GetStrContext(ctx context.Context, key string) (string, error) {
+	kv, _, err := c.GetContext(ctx, key)
 	if err != nil {
 		return "", err
 	}
-	return string(kv.Value), nil
+	return string(trimBOM(kv.Value)), nil
+}
+
+var utf8BOM = []byte("\ufeff")
+
+// trimBOM strips the UTF-8 byte order mark some editors prepend to text,
+// raw values of Get are left untouched for binary safety
+func trimBOM(value []byte) []byte {
+	return bytes.TrimPrefix(value, utf8BOM)
 }
 
 func (c *client) GetInt(key string) (int, error) {
-	v, err := c.GetStr(key)
+	return c.GetIntContext(context.Background(), key)
+}
+
+// GetIntContext is GetInt cancelled when ctx is done
+func (c *client) GetIntContext(ctx context.Context, key string) (int, error) {
+	v, err := c.GetStrContext(ctx, key)
 	if err != nil {
 		return 0, err
 	}
@@ -143,46 +810,210 @@ func (c *client) GetInt(key string) (int, error) {
 	return res, nil
 }
 
+// GetWithSession returns the string value and the session holding the key,
+// the session is empty when the key is not locked
+func (c *client) GetWithSession(key string) (string, string, error) {
+	return c.GetWithSessionContext(context.Background(), key)
+}
+
+// GetWithSessionContext is GetWithSession cancelled when ctx is done
+func (c *client) GetWithSessionContext(ctx context.Context, key string) (string, string, error) {
+	kv, _, err := c.GetContext(ctx, key)
+	if err != nil {
+		return "", "", err
+	}
+	return string(trimBOM(kv.Value)), kv.Session, nil
+}
+
+// GetIntOrDefault returns def when the key is missing or its value is
+// blank, like a LoadStruct default
+func (c *client) GetIntOrDefault(key string, def int) (int, error) {
+	return c.GetIntOrDefaultContext(context.Background(), key, def)
+}
+
+// GetIntOrDefaultContext is GetIntOrDefault cancelled when ctx is done
+func (c *client) GetIntOrDefaultContext(ctx context.Context, key string, def int) (int, error) {
+	v, err := c.GetStrContext(ctx, key)
+	if err != nil {
+		if _, ok := err.(ErrKVNotFound); ok {
+			return def, nil
+		}
+		return 0, err
+	}
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return def, nil
+	}
+	return strconv.Atoi(v)
+}
+
+// GetBool bool
+func (c *client) GetBool(key string) (bool, error) {
+	return c.GetBoolContext(context.Background(), key)
+}
+
+// GetBoolContext is GetBool cancelled when ctx is done
+func (c *client) GetBoolContext(ctx context.Context, key string) (bool, error) {
+	v, err := c.GetStrContext(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	return c.parseBool(v)
+}
+
+func (c *client) parseBool(v string) (bool, error) {
+	v = strings.TrimSpace(v)
+	if c.permissiveBool {
+		switch strings.ToLower(v) {
+		case "yes", "on":
+			return true, nil
+		case "no", "off":
+			return false, nil
+		}
+	}
+	return strconv.ParseBool(v)
+}
+
 // Put KVPair
 func (c *client) Put(key string, value string) (*consulapi.WriteMeta, error) {
-	p := &consulapi.KVPair{Key: key, Value: []byte(value)}
-	return c.kv.Put(p, nil)
+	return c.PutContext(context.Background(), key, value)
 }
 
-// RegisterService a service with consul local agent
-func (c *client) RegisterService(name string, addr string, tags ...string) error {
-	host, strPort, err := net.SplitHostPort(addr)
-	if err != nil {
-		return ErrInvalidServiceAddr
+// Delete KVPair
+func (c *client) Delete(key string) (*consulapi.WriteMeta, error) {
+	return c.DeleteContext(context.Background(), key)
+}
+
+// PutGob encodes v with encoding/gob and puts it as KVPair
+func (c *client) PutGob(key string, v interface{}) error {
+	return c.PutGobContext(context.Background(), key, v)
+}
+
+// PutGobContext is PutGob cancelled when ctx is done
+func (c *client) PutGobContext(ctx context.Context, key string, v interface{}) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return err
 	}
+	p := &consulapi.KVPair{Key: key, Value: buf.Bytes()}
+	_, err := c.kv.Put(p, (&consulapi.WriteOptions{}).WithContext(ctx))
+	return err
+}
+
+// GetGob decodes a gob encoded KVPair value into v
+func (c *client) GetGob(key string, v interface{}) error {
+	return c.GetGobContext(context.Background(), key, v)
+}
 
-	port, err := strconv.Atoi(strPort)
+// GetGobContext is GetGob cancelled when ctx is done
+func (c *client) GetGobContext(ctx context.Context, key string, v interface{}) error {
+	kv, _, err := c.GetContext(ctx, key)
 	if err != nil {
-		return ErrInvalidPort
+		return err
 	}
+	return gob.NewDecoder(bytes.NewReader(kv.Value)).Decode(v)
+}
+
+// RegisterService a service with consul local agent, its 3s TTL check is
+// passed in the background until StopHeartbeat or DeRegisterService
+func (c *client) RegisterService(name string, addr string, tags ...string) error {
+	return c.RegisterServiceContext(context.Background(), name, addr, tags...)
+}
 
-	reg := &consulapi.AgentServiceRegistration{
-		ID:      name,
+// RegisterServiceContext is RegisterService cancelled when ctx is done, the
+// heartbeat outlives ctx
+func (c *client) RegisterServiceContext(ctx context.Context, name string, addr string, tags ...string) error {
+	return c.RegisterServiceWithHeartbeatContext(ctx, ServiceOptions{
 		Name:    name,
-		Address: host,
-		Port:    port,
+		Address: addr,
 		Tags:    tags,
-		Check: &consulapi.AgentServiceCheck{
-			TTL: "3s",
-			DeregisterCriticalServiceAfter: "10s",
-		},
-	}
-	return c.agent.ServiceRegister(reg)
+	})
 }
 
 // DeRegisterService a service with consul local agent
 func (c *client) DeRegisterService(id string) error {
-	return c.agent.ServiceDeregister(id)
+	return c.DeRegisterServiceContext(context.Background(), id)
+}
+
+// DeRegisterServiceContext is DeRegisterService cancelled when ctx is done
+func (c *client) DeRegisterServiceContext(ctx context.Context, id string) error {
+	if err := c.agent.ServiceDeregisterOpts(id, (&consulapi.QueryOptions{}).WithContext(ctx)); err != nil {
+		return err
+	}
+	c.ownMu.Lock()
+	delete(c.own, id)
+	c.ownMu.Unlock()
+	c.StopHeartbeat(id)
+	return nil
+}
+
+// StopHeartbeat stops passing the TTL check of the service id registered
+// by RegisterService or RegisterServiceWithHeartbeat, which stays
+// registered and goes critical once its TTL expires
+func (c *client) StopHeartbeat(id string) {
+	c.ownMu.Lock()
+	checkID, ok := c.heartbeated[id]
+	delete(c.heartbeated, id)
+	c.ownMu.Unlock()
+	if ok {
+		c.heartbeats.Remove(checkID)
+	}
+}
+
+// DrainAndDeregister puts the service in maintenance mode, removing it from
+// passing discovery, waits grace for in-flight requests to finish and then
+// deregisters it. ctx cuts the grace period short, the service is
+// deregistered anyway and the error of ctx returned.
+func (c *client) DrainAndDeregister(ctx context.Context, serviceID string, grace time.Duration) error {
+	if err := c.agent.EnableServiceMaintenance(serviceID, "draining before deregistration"); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+
+	if err := c.DeRegisterService(serviceID); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// DeRegisterAllOwn deregisters the services registered by this client,
+// services registered elsewhere are left alone
+func (c *client) DeRegisterAllOwn() error {
+	return c.DeRegisterAllOwnContext(context.Background())
+}
+
+// DeRegisterAllOwnContext is DeRegisterAllOwn cancelled when ctx is done
+func (c *client) DeRegisterAllOwnContext(ctx context.Context) error {
+	c.ownMu.Lock()
+	ids := make([]string, 0, len(c.own))
+	for id := range c.own {
+		ids = append(ids, id)
+	}
+	c.ownMu.Unlock()
+
+	var firstErr error
+	for _, id := range ids {
+		if err := c.DeRegisterServiceContext(ctx, id); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
 }
 
 // GetFirstService get first service
 func (c *client) GetFirstService(service string, tag string) (*consulapi.ServiceEntry, *consulapi.QueryMeta, error) {
-	addrs, meta, err := c.GetServices(service, tag)
+	return c.GetFirstServiceContext(context.Background(), service, tag)
+}
+
+// GetFirstServiceContext is GetFirstService cancelled when ctx is done
+func (c *client) GetFirstServiceContext(ctx context.Context, service string, tag string) (*consulapi.ServiceEntry, *consulapi.QueryMeta, error) {
+	addrs, meta, err := c.GetServicesContext(ctx, service, tag)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -192,12 +1023,55 @@ func (c *client) GetFirstService(service string, tag string) (*consulapi.Service
 	return addrs[0], meta, nil
 }
 
+// GetFirstLocalService returns a passing instance on the node of the local
+// agent if any, to save a network hop, or else the first passing instance
+func (c *client) GetFirstLocalService(service string, tag string) (*consulapi.ServiceEntry, *consulapi.QueryMeta, error) {
+	return c.GetFirstLocalServiceContext(context.Background(), service, tag)
+}
+
+// GetFirstLocalServiceContext is GetFirstLocalService cancelled when ctx is
+// done
+func (c *client) GetFirstLocalServiceContext(ctx context.Context, service string, tag string) (*consulapi.ServiceEntry, *consulapi.QueryMeta, error) {
+	addrs, meta, err := c.GetServicesContext(ctx, service, tag)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, nil, fmt.Errorf("service \"%s\" not found", service)
+	}
+	node, err := c.agent.NodeName()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, addr := range addrs {
+		if addr.Node != nil && addr.Node.Node == node {
+			return addr, meta, nil
+		}
+	}
+	return addrs[0], meta, nil
+}
+
 // GetServices return a services
 func (c *client) GetServices(service string, tag string) ([]*consulapi.ServiceEntry, *consulapi.QueryMeta, error) {
+	return c.GetServicesContext(context.Background(), service, tag)
+}
+
+// GetServicesContext is GetServices cancelled when ctx is done
+func (c *client) GetServicesContext(ctx context.Context, service string, tag string) ([]*consulapi.ServiceEntry, *consulapi.QueryMeta, error) {
+	if c.onDiscovery == nil {
+		return c.getServices(ctx, service, tag)
+	}
+	start := time.Now()
+	addrs, meta, err := c.getServices(ctx, service, tag)
+	c.onDiscovery(service, len(addrs), time.Since(start), err)
+	return addrs, meta, err
+}
+
+func (c *client) getServices(ctx context.Context, service string, tag string) ([]*consulapi.ServiceEntry, *consulapi.QueryMeta, error) {
 	passingOnly := true
-	addrs, meta, err := c.health.Service(service, tag, passingOnly, nil)
+	addrs, meta, err := c.health.Service(service, tag, passingOnly, (&consulapi.QueryOptions{}).WithContext(ctx))
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, leaderError(err)
 	}
 	if len(addrs) == 0 {
 		return nil, nil, errors.New(fmt.Sprintf("service \"%s\" not found", service))
@@ -206,10 +1080,193 @@ func (c *client) GetServices(service string, tag string) ([]*consulapi.ServiceEn
 }
 
 func (c *client) LoadStruct(parent string, i interface{}) error {
-	return c.recursiveLoadStruct(parent, reflect.ValueOf(i).Elem())
+	return c.LoadStructWithOptions(parent, i, LoadOptions{})
+}
+
+// LoadStructContext is LoadStruct cancelled when ctx is done
+func (c *client) LoadStructContext(ctx context.Context, parent string, i interface{}) error {
+	return c.LoadStructWithOptions(parent, i, LoadOptions{ctx: ctx})
+}
+
+// LoadStructReport is LoadStruct also reporting which fields were read
+// from KV, set from their default or left zero, to flag incomplete config
+func (c *client) LoadStructReport(parent string, i interface{}) (LoadReport, error) {
+	return c.LoadStructReportContext(context.Background(), parent, i)
+}
+
+// LoadStructReportContext is LoadStructReport cancelled when ctx is done
+func (c *client) LoadStructReportContext(ctx context.Context, parent string, i interface{}) (LoadReport, error) {
+	var report LoadReport
+	err := c.LoadStructWithOptions(parent, i, LoadOptions{ctx: ctx, report: &report})
+	return report, err
+}
+
+// LoadStructProfile loads struct fields from the KVPairs under
+// basePrefix/default then overlays the ones existing under
+// basePrefix/profile, e.g. a profile read from an env var. A missing
+// profile prefix leaves the defaults as is.
+func (c *client) LoadStructProfile(basePrefix, profile string, i interface{}) error {
+	return c.LoadStructProfileContext(context.Background(), basePrefix, profile, i)
+}
+
+// LoadStructProfileContext is LoadStructProfile cancelled when ctx is done
+func (c *client) LoadStructProfileContext(ctx context.Context, basePrefix, profile string, i interface{}) error {
+	if err := c.LoadStructContext(ctx, basePrefix+"/default", i); err != nil {
+		return err
+	}
+	return c.LoadStructWithOptions(basePrefix+"/"+profile, i, LoadOptions{Overlay: true, ctx: ctx})
+}
+
+// LoadStructs loads each prefix into its struct concurrently, the errors of
+// all failed loads are joined and prefixed with their prefix
+func (c *client) LoadStructs(specs map[string]interface{}) error {
+	return c.LoadStructsContext(context.Background(), specs)
+}
+
+// LoadStructsContext is LoadStructs cancelled when ctx is done
+func (c *client) LoadStructsContext(ctx context.Context, specs map[string]interface{}) error {
+	prefixes := make([]string, 0, len(specs))
+	for prefix := range specs {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+
+	errs := make([]error, len(prefixes))
+	var wg sync.WaitGroup
+	for n, prefix := range prefixes {
+		wg.Add(1)
+		go func(n int, prefix string) {
+			defer wg.Done()
+			if err := c.LoadStructContext(ctx, prefix, specs[prefix]); err != nil {
+				errs[n] = fmt.Errorf("load \"%s\": %w", prefix, err)
+			}
+		}(n, prefix)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
 }
 
-func (c *client) recursiveLoadStruct(parent string, val reflect.Value) error {
+// AfterLoader is implemented by structs to compute derived fields or
+// validate once loaded, an error aborts the load
+type AfterLoader interface {
+	AfterLoad() error
+}
+
+// LoadOptions options for LoadStructWithOptions
+type LoadOptions struct {
+	// Consistent reads every KVPair with RequireConsistent, trading latency
+	// for never reading stale config right after a write
+	Consistent bool
+	// RelativePaths reports field paths relative to the loaded struct in
+	// errors (e.g. Nested/Delay) instead of the full KV path
+	RelativePaths bool
+	// Overlay leaves the fields whose KVPair does not exist unchanged,
+	// ignoring their default, to apply a prefix over an already loaded struct
+	Overlay bool
+	// Datacenter reads the KVPairs from, defaults to the datacenter of the
+	// agent
+	Datacenter string
+
+	ctx    context.Context
+	report *LoadReport
+}
+
+// LoadReport the fields of a loaded struct by source of their value, as
+// paths relative to the struct (e.g. Nested/Delay)
+type LoadReport struct {
+	// FromKV fields read from a KVPair
+	FromKV []string
+	// FromDefault fields set from their default tag, i.e. missing config
+	FromDefault []string
+	// Zero fields with neither a KVPair nor a default
+	Zero []string
+}
+
+// record adds the field to the report of the load, if any
+func (o LoadOptions) record(fieldPath string, src valueSource) {
+	if o.report == nil {
+		return
+	}
+	switch src {
+	case sourceKV:
+		o.report.FromKV = append(o.report.FromKV, fieldPath)
+	case sourceDefault:
+		o.report.FromDefault = append(o.report.FromDefault, fieldPath)
+	default:
+		o.report.Zero = append(o.report.Zero, fieldPath)
+	}
+}
+
+// errPath returns the path of a field to report in errors
+func (o LoadOptions) errPath(path string, fieldPath string) string {
+	if o.RelativePaths {
+		return fieldPath
+	}
+	return path
+}
+
+func (o LoadOptions) queryOptions() *consulapi.QueryOptions {
+	q := &consulapi.QueryOptions{RequireConsistent: o.Consistent, Datacenter: o.Datacenter}
+	if o.ctx != nil {
+		q = q.WithContext(o.ctx)
+	}
+	return q
+}
+
+// LoadStructWithFailover loads struct fields from the KVPairs under parent
+// in the first of dcs having any, moving on to the next datacenter when
+// one is unreachable. ErrKVNotFound is returned when no datacenter has the
+// parent prefix.
+func (c *client) LoadStructWithFailover(parent string, dcs []string, i interface{}) error {
+	return c.LoadStructWithFailoverContext(context.Background(), parent, dcs, i)
+}
+
+// LoadStructWithFailoverContext is LoadStructWithFailover cancelled when ctx
+// is done
+func (c *client) LoadStructWithFailoverContext(ctx context.Context, parent string, dcs []string, i interface{}) error {
+	var errs []error
+	for _, dc := range dcs {
+		keys, _, err := c.kv.Keys(parent, "", (&consulapi.QueryOptions{Datacenter: dc}).WithContext(ctx))
+		if err != nil {
+			if !dcUnreachable(err) {
+				return leaderError(err)
+			}
+			errs = append(errs, fmt.Errorf("datacenter \"%s\": %w", dc, err))
+			continue
+		}
+		if len(keys) == 0 {
+			continue
+		}
+		return c.LoadStructWithOptions(parent, i, LoadOptions{Datacenter: dc, ctx: ctx})
+	}
+	if len(errs) > 0 {
+		return errors.Join(append([]error{ErrKVNotFound{Key: parent}}, errs...)...)
+	}
+	return ErrKVNotFound{Key: parent}
+}
+
+// dcUnreachable reports whether err is a server error of a datacenter,
+// e.g. no path to it or no leader, as opposed to a rejected request
+func dcUnreachable(err error) bool {
+	var statusErr consulapi.StatusError
+	return errors.As(err, &statusErr) && statusErr.Code >= 500
+}
+
+// LoadStructWithOptions loads struct fields from the KVPairs under parent
+func (c *client) LoadStructWithOptions(parent string, i interface{}, opts LoadOptions) error {
+	return c.recursiveLoadStruct(parent, "", reflect.ValueOf(i).Elem(), opts)
+}
+
+// LoadStructWithOptionsContext is LoadStructWithOptions cancelled when ctx
+// is done
+func (c *client) LoadStructWithOptionsContext(ctx context.Context, parent string, i interface{}, opts LoadOptions) error {
+	opts.ctx = ctx
+	return c.LoadStructWithOptions(parent, i, opts)
+}
+
+// recursiveLoadStruct loads the fields of val from the KVPairs under
+// parent, fieldParent is the path of val in the loaded struct
+func (c *client) recursiveLoadStruct(parent string, fieldParent string, val reflect.Value, opts LoadOptions) error {
 	for i := 0; i < val.NumField(); i++ {
 		value := val.Field(i)
 		field := val.Type().Field(i)
@@ -233,46 +1290,207 @@ func (c *client) recursiveLoadStruct(parent string, val reflect.Value) error {
 		}
 
 		path := fmt.Sprintf("%s/%s", parent, kvName)
+		fieldPath := field.Name
+		if fieldParent != "" {
+			fieldPath = fieldParent + "/" + field.Name
+		}
+		errPath := opts.errPath(path, fieldPath)
 
 		if _, ok := value.Interface().(time.Time); ok {
+			layout, err := timeLayout(tagOptions)
+			if err != nil {
+				return ErrFieldParse{Path: errPath, Kind: field.Type.Kind(), Underlying: err}
+			}
+			fieldValue, src, err := c.fieldValue(path, errPath, val, i, tagOptions, opts)
+			if err != nil {
+				return err
+			}
+			if src == sourceNone {
+				opts.record(fieldPath, src)
+				continue
+			}
+			t, err := time.Parse(layout, strings.TrimSpace(string(fieldValue)))
+			if err != nil {
+				return ErrFieldParse{Path: errPath, Kind: field.Type.Kind(), Underlying: err}
+			}
+			value.Set(reflect.ValueOf(t))
+			opts.record(fieldPath, src)
+		} else if isIPNet(field.Type) {
+			// net.IP is a TextUnmarshaler, net.IPNet is not
+			fieldValue, src, err := c.fieldValue(path, errPath, val, i, tagOptions, opts)
+			if err != nil {
+				return err
+			}
+			if src == sourceNone {
+				opts.record(fieldPath, src)
+				continue
+			}
+			_, ipNet, err := net.ParseCIDR(strings.TrimSpace(string(fieldValue)))
+			if err != nil {
+				return ErrFieldParse{Path: errPath, Kind: field.Type.Kind(), Underlying: err}
+			}
+			if field.Type.Kind() == reflect.Ptr {
+				value.Set(reflect.ValueOf(ipNet))
+			} else {
+				value.Set(reflect.ValueOf(*ipNet))
+			}
+			opts.record(fieldPath, src)
+		} else if u, ok := value.Addr().Interface().(encoding.TextUnmarshaler); ok {
+			// types like uuid.UUID are loaded from a single key even when
+			// declared as structs
+			fieldValue, src, err := c.fieldValue(path, errPath, val, i, tagOptions, opts)
+			if err != nil {
+				return err
+			}
+			if src == sourceNone {
+				opts.record(fieldPath, src)
+				continue
+			}
+			if err := u.UnmarshalText(fieldValue); err != nil {
+				return ErrFieldParse{Path: errPath, Kind: field.Type.Kind(), Underlying: err}
+			}
+			opts.record(fieldPath, src)
 		} else if field.Type.Kind() == reflect.Struct {
-			err = c.recursiveLoadStruct(path, value)
+			err = c.recursiveLoadStruct(path, fieldPath, value, opts)
 			if err != nil {
 				return err
 			}
 		} else {
-			kv, _, err := c.Get(path)
-
+			fieldValue, src, err := c.fieldValue(path, errPath, val, i, tagOptions, opts)
 			if err != nil {
-				if _, ok := err.(ErrKVNotFound); !ok {
-					return err
-				}
+				return err
+			}
+			if src == sourceNone && opts.Overlay {
+				continue
 			}
 
-			var fieldValue []byte
-
-			if kv == nil {
-				if defaultValue, ok := tagOptions["default"]; ok {
-					fieldValue = []byte(defaultValue)
-				}
+			var v interface{}
+			if size, _ := strconv.ParseBool(tagOptions["size"]); size {
+				v, err = sizeValue(field.Type, fieldValue)
 			} else {
-				fieldValue = kv.Value
+				v, err = c.normalizeValue(field.Type, fieldValue)
 			}
-
-			v, err := c.normalizeValue(field.Type.Kind(), fieldValue)
 			if err != nil {
-				return err
+				return ErrFieldParse{Path: errPath, Kind: field.Type.Kind(), Underlying: err}
+			}
+			// named types (e.g. type Level uint8) need the parsed value converted
+			rv := reflect.ValueOf(v)
+			if !rv.Type().ConvertibleTo(field.Type) {
+				err := fmt.Errorf("can not convert %s to %s", rv.Type(), field.Type)
+				return ErrFieldParse{Path: errPath, Kind: field.Type.Kind(), Underlying: err}
 			}
-			value.Set(reflect.ValueOf(v))
+			value.Set(rv.Convert(field.Type))
+			opts.record(fieldPath, src)
+		}
+	}
+
+	// nested structs were loaded above so their hooks already ran
+	if hook, ok := val.Addr().Interface().(AfterLoader); ok {
+		if err := hook.AfterLoad(); err != nil {
+			return fmt.Errorf("after load of \"%s\": %w", parent, err)
 		}
 	}
 	return nil
 }
 
-func (c *client) normalizeValue(kind reflect.Kind, value []byte) (interface{}, error) {
+var ipNetType = reflect.TypeOf(net.IPNet{})
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// isIPNet reports whether t is net.IPNet or *net.IPNet, loaded from CIDR
+// notation
+func isIPNet(t reflect.Type) bool {
+	return t == ipNetType || t == reflect.PtrTo(ipNetType)
+}
+
+// timeLayout returns the layout of a time.Time field, set with the layout
+// tag option and defaulting to RFC3339
+func timeLayout(tagOptions map[string]string) (string, error) {
+	layout, ok := tagOptions["layout"]
+	if !ok {
+		return time.RFC3339, nil
+	}
+	// a layout without any layout element formats every time as itself
+	if time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC).Format(layout) == layout {
+		return "", fmt.Errorf("invalid layout \"%s\"", layout)
+	}
+	return layout, nil
+}
+
+// valueSource where the value of a field comes from
+type valueSource int
+
+const (
+	sourceNone valueSource = iota
+	sourceKV
+	sourceDefault
+)
+
+// fieldValue returns the value stored at path for the field at index of val,
+// or its default when the key does not exist. The source is sourceNone when
+// there is neither or the key does not exist in an overlay.
+func (c *client) fieldValue(path, errPath string, val reflect.Value, index int, tagOptions map[string]string, opts LoadOptions) ([]byte, valueSource, error) {
+	encrypted, err := c.encrypted(tagOptions, errPath)
+	if err != nil {
+		return nil, sourceNone, err
+	}
+	kv, _, err := c.get(path, opts.queryOptions())
+	if err != nil {
+		if _, ok := err.(ErrKVNotFound); !ok {
+			return nil, sourceNone, err
+		}
+	}
+	if kv != nil && encrypted {
+		// defaults are plain text, only stored values are encrypted
+		value, err := c.cipher.Decrypt(kv.Value)
+		if err != nil {
+			return nil, sourceNone, fmt.Errorf("decrypt \"%s\": %w", errPath, err)
+		}
+		return trimBOM(value), sourceKV, nil
+	}
+	if kv != nil {
+		return trimBOM(kv.Value), sourceKV, nil
+	}
+
+	defaultValue, ok := tagOptions["default"]
+	if !ok || opts.Overlay {
+		return nil, sourceNone, nil
+	}
+	defaultValue, err = interpolateDefault(val, index, defaultValue)
+	if err != nil {
+		return nil, sourceNone, fmt.Errorf("default of \"%s\": %w", errPath, err)
+	}
+	return []byte(defaultValue), sourceDefault, nil
+}
+
+// sizeValue parses the byte size of an int field tagged size
+func sizeValue(typ reflect.Type, value []byte) (interface{}, error) {
+	switch typ.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+	default:
+		return nil, fmt.Errorf("size of unsupported type \"%s\"", typ.Kind())
+	}
+	n, err := parseByteSize(string(value))
+	if err != nil {
+		return nil, err
+	}
+	if reflect.Zero(typ).OverflowInt(n) {
+		return nil, fmt.Errorf("size %d overflows %s", n, typ)
+	}
+	return n, nil
+}
+
+func (c *client) normalizeValue(typ reflect.Type, value []byte) (interface{}, error) {
+	kind := typ.Kind()
 	switch kind {
 	case reflect.String:
 		return string(value), nil
+	case reflect.Bool:
+		b, err := c.parseBool(string(value))
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
 	case reflect.Float32:
 		n, err := strconv.ParseFloat(strings.TrimSpace(string(value)), 32)
 		if err != nil {
@@ -285,31 +1503,92 @@ func (c *client) normalizeValue(kind reflect.Kind, value []byte) (interface{}, e
 			return nil, err
 		}
 		return n, nil
-	case reflect.Int:
-		n, err := strconv.ParseInt(strings.TrimSpace(string(value)), 10, 64)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if typ == durationType {
+			return time.ParseDuration(strings.TrimSpace(string(value)))
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(string(value)), 10, typ.Bits())
+		if err != nil {
+			return nil, err
+		}
+		return n, nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(strings.TrimSpace(string(value)), 10, typ.Bits())
 		if err != nil {
 			return nil, err
 		}
-		return int(n), nil
+		return n, nil
+	case reflect.Array:
+		return c.normalizeArray(typ, value)
 	default:
 		return nil, errors.New(fmt.Sprintf("unsupported type \"%s\"", kind.String()))
 	}
 }
 
-func (c *client) getTagOptions(v string) (map[string]string, error) {
-	parts := strings.Split(v, ":")
+// normalizeArray parses a comma separated list into an array of typ, the
+// number of elements must match the array length
+func (c *client) normalizeArray(typ reflect.Type, value []byte) (interface{}, error) {
+	parts := strings.Split(string(value), ",")
+	if len(parts) != typ.Len() {
+		return nil, fmt.Errorf("%d elements for an array of length %d", len(parts), typ.Len())
+	}
 
-	size := len(parts)
-	if size%2 != 0 {
-		return nil, ErrInvalidTagOptions
+	arr := reflect.New(typ).Elem()
+	for i, part := range parts {
+		v, err := c.normalizeValue(typ.Elem(), []byte(strings.TrimSpace(part)))
+		if err != nil {
+			return nil, fmt.Errorf("element %d: %w", i, err)
+		}
+		rv := reflect.ValueOf(v)
+		if !rv.Type().ConvertibleTo(typ.Elem()) {
+			return nil, fmt.Errorf("element %d: can not convert %s to %s", i, rv.Type(), typ.Elem())
+		}
+		arr.Index(i).Set(rv.Convert(typ.Elem()))
 	}
+	return arr.Interface(), nil
+}
+
+var defaultRefRe = regexp.MustCompile(`\$\{(\w+)\}`)
+
+// interpolateDefault replaces ${Field} references in the default value of
+// the field at index with the values of the fields declared before it
+func interpolateDefault(val reflect.Value, index int, def string) (string, error) {
+	var err error
+	res := defaultRefRe.ReplaceAllStringFunc(def, func(ref string) string {
+		name := defaultRefRe.FindStringSubmatch(ref)[1]
+		field, ok := val.Type().FieldByName(name)
+		if !ok || len(field.Index) != 1 || field.Index[0] >= index {
+			if err == nil {
+				err = fmt.Errorf("undefined reference %s, only fields declared before can be referenced", ref)
+			}
+			return ref
+		}
+		return fmt.Sprint(val.Field(field.Index[0]).Interface())
+	})
+	return res, err
+}
+
+func (c *client) getTagOptions(v string) (map[string]string, error) {
+	parts := strings.Split(v, ":")
 
 	res := make(map[string]string)
 	for i := 0; i < len(parts); i += 2 {
 		name := parts[i]
+		if name == "layout" && i+1 < len(parts) {
+			// layouts contain colons (e.g. 15:04), so a layout is the last
+			// option and takes the rest of the tag
+			res[name] = strings.Join(parts[i+1:], ":")
+			break
+		}
+		if i+1 >= len(parts) {
+			return nil, ErrInvalidTagOptions
+		}
 		value := parts[i+1]
 
 		if !c.allowOption(name) {
+			if c.strictTags {
+				return nil, fmt.Errorf("%w: unknown option \"%s\" in \"%s\"", ErrInvalidTagOptions, name, v)
+			}
 			continue
 		}
 
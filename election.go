@@ -0,0 +1,106 @@
+package consul
+
+import (
+	"context"
+	"time"
+)
+
+// LeaderEvent a change of leadership of a LeaderElector
+type LeaderEvent int
+
+const (
+	// IsLeader the elector acquired the leadership
+	IsLeader LeaderEvent = iota + 1
+	// LostLeadership the elector lost or gave up the leadership
+	LostLeadership
+)
+
+func (e LeaderEvent) String() string {
+	switch e {
+	case IsLeader:
+		return "IsLeader"
+	case LostLeadership:
+		return "LostLeadership"
+	default:
+		return "LeaderEvent(?)"
+	}
+}
+
+// leaderRetryDelay delay before campaigning again after a failure to
+// reach consul
+const leaderRetryDelay = time.Second
+
+// LeaderElector campaigns for the leadership of key, held with Lock by the
+// session of a single elector at a time
+type LeaderElector struct {
+	c      Client
+	key    string
+	nodeID string
+	events chan LeaderEvent
+}
+
+// NewLeaderElection returns a LeaderElector of key identifying the
+// candidate with nodeID, stored as the value of key while leader. Run
+// starts the campaign.
+func NewLeaderElection(c Client, key, nodeID string) *LeaderElector {
+	return &LeaderElector{
+		c:      c,
+		key:    key,
+		nodeID: nodeID,
+		events: make(chan LeaderEvent),
+	}
+}
+
+// Events returns the channel of the leadership changes, it must be read
+// for the campaign to progress and is closed when Run returns
+func (e *LeaderElector) Events() <-chan LeaderEvent {
+	return e.events
+}
+
+// Run campaigns until ctx is done: it waits for the leadership, emits
+// IsLeader, holds it renewing the session and emits LostLeadership once
+// lost, then campaigns again. The leadership is released when ctx is done
+// and the error of ctx returned.
+func (e *LeaderElector) Run(ctx context.Context) error {
+	defer close(e.events)
+	for {
+		lock, err := e.c.Lock(e.key, WithLockValue([]byte(e.nodeID)), WithLockContext(ctx))
+		if err != nil {
+			select {
+			case <-time.After(leaderRetryDelay):
+				continue
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		if !e.emit(ctx, IsLeader) {
+			lock.Unlock()
+			return ctx.Err()
+		}
+		select {
+		case <-lock.Lost():
+			lock.Unlock()
+			if !e.emit(ctx, LostLeadership) {
+				return ctx.Err()
+			}
+		case <-ctx.Done():
+			lock.Unlock()
+			// the caller may still be reading events
+			select {
+			case e.events <- LostLeadership:
+			default:
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+func (e *LeaderElector) emit(ctx context.Context, ev LeaderEvent) bool {
+	select {
+	case e.events <- ev:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,109 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// GetAs gets the value of key parsed as T: string, int, bool, float64 and
+// time.Duration are parsed from their text form, any other type is JSON
+// decoded
+func GetAs[T any](c Client, key string) (T, error) {
+	var res T
+	var err error
+
+	switch p := any(&res).(type) {
+	case *string:
+		*p, err = c.GetStr(key)
+	case *int:
+		*p, err = c.GetInt(key)
+	case *bool:
+		*p, err = c.GetBool(key)
+	case *float64:
+		var v string
+		if v, err = c.GetStr(key); err == nil {
+			*p, err = strconv.ParseFloat(strings.TrimSpace(v), 64)
+		}
+	case *time.Duration:
+		var v string
+		if v, err = c.GetStr(key); err == nil {
+			*p, err = time.ParseDuration(strings.TrimSpace(v))
+		}
+	default:
+		var v string
+		if v, err = c.GetStr(key); err == nil {
+			err = json.Unmarshal([]byte(v), p)
+		}
+	}
+	return res, err
+}
+
+// treeWatcher is implemented by the clients of this package
+type treeWatcher interface {
+	prefixIndex(ctx context.Context, prefix string) (uint64, error)
+	watchPrefix(ctx context.Context, prefix string, lastIndex uint64, fn func(consulapi.KVPairs)) error
+}
+
+// WatchConfig loads a T from the KVPairs under parent and stores it in the
+// returned pointer, swapping in a freshly loaded T whenever a key under
+// parent changes, so readers just Load it without locking. Reload and
+// watch errors are sent on the error channel, dropped when it is full.
+// The watch stops when ctx is done, interrupting a reload in flight.
+func WatchConfig[T any](ctx context.Context, c Client, parent string) (*atomic.Pointer[T], <-chan error, error) {
+	w, ok := c.(treeWatcher)
+	if !ok {
+		return nil, nil, errors.New("client does not support watching config")
+	}
+
+	load := func() (*T, error) {
+		v := new(T)
+		if err := c.LoadStructContext(ctx, parent, v); err != nil {
+			return nil, err
+		}
+		return v, nil
+	}
+
+	// the index is read first so a change during the load is not missed
+	index, err := w.prefixIndex(ctx, parent)
+	if err != nil {
+		return nil, nil, err
+	}
+	v, err := load()
+	if err != nil {
+		return nil, nil, err
+	}
+	p := &atomic.Pointer[T]{}
+	p.Store(v)
+
+	errs := make(chan error, 1)
+	report := func(err error) {
+		select {
+		case errs <- err:
+		default:
+		}
+	}
+	go func() {
+		defer close(errs)
+		err := w.watchPrefix(ctx, parent, index, func(consulapi.KVPairs) {
+			v, err := load()
+			if err != nil {
+				if ctx.Err() == nil {
+					report(err)
+				}
+				return
+			}
+			p.Store(v)
+		})
+		if ctx.Err() == nil {
+			report(err)
+		}
+	}()
+	return p, errs, nil
+}
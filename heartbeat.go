@@ -0,0 +1,118 @@
+package consul
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// HeartbeatManager passes many TTL checks from a single goroutine, each on
+// its own interval. The goroutine runs while checks are added.
+type HeartbeatManager struct {
+	agent *consulapi.Agent
+
+	mu      sync.Mutex
+	checks  map[string]*heartbeat
+	running bool
+	wake    chan struct{}
+}
+
+type heartbeat struct {
+	interval time.Duration
+	next     time.Time
+}
+
+func newHeartbeatManager(agent *consulapi.Agent) *HeartbeatManager {
+	return &HeartbeatManager{
+		agent:  agent,
+		checks: make(map[string]*heartbeat),
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// Heartbeats returns the HeartbeatManager of the client
+func (c *client) Heartbeats() *HeartbeatManager {
+	return c.heartbeats
+}
+
+// Add passes the TTL check checkID now and then every interval, replacing
+// the interval of a check already added. The interval must be positive.
+func (m *HeartbeatManager) Add(checkID string, interval time.Duration) error {
+	if interval <= 0 {
+		return fmt.Errorf("%w: heartbeat interval %s must be positive", ErrInvalidCheckOptions, interval)
+	}
+	m.mu.Lock()
+	m.checks[checkID] = &heartbeat{interval: interval}
+	if !m.running {
+		m.running = true
+		go m.run()
+	}
+	m.mu.Unlock()
+	m.notify()
+	return nil
+}
+
+// Remove stops passing the TTL check checkID, it goes critical once its
+// TTL expires unless deregistered
+func (m *HeartbeatManager) Remove(checkID string) {
+	m.mu.Lock()
+	delete(m.checks, checkID)
+	m.mu.Unlock()
+	m.notify()
+}
+
+func (m *HeartbeatManager) notify() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run passes the due checks and sleeps until the next one is due, it
+// returns once no check is left
+func (m *HeartbeatManager) run() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-m.wake:
+		}
+
+		now := time.Now()
+		var due []string
+		var next time.Time
+		m.mu.Lock()
+		if len(m.checks) == 0 {
+			m.running = false
+			m.mu.Unlock()
+			return
+		}
+		for id, hb := range m.checks {
+			if !hb.next.After(now) {
+				due = append(due, id)
+				hb.next = now.Add(hb.interval)
+			}
+			if next.IsZero() || hb.next.Before(next) {
+				next = hb.next
+			}
+		}
+		m.mu.Unlock()
+
+		// a failed update is not retried before the next interval, the
+		// check goes critical if updates keep failing for its TTL
+		for _, id := range due {
+			m.agent.UpdateTTL(id, "", consulapi.HealthPassing)
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(time.Until(next))
+	}
+}
@@ -0,0 +1,425 @@
+package consul
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// TreeChecksum returns a stable hash of all keys and values under prefix,
+// adding, removing or modifying any key changes the checksum
+func (c *client) TreeChecksum(prefix string) (string, error) {
+	return c.TreeChecksumContext(context.Background(), prefix)
+}
+
+// TreeChecksumContext is TreeChecksum cancelled when ctx is done
+func (c *client) TreeChecksumContext(ctx context.Context, prefix string) (string, error) {
+	pairs, _, err := c.kv.List(prefix, (&consulapi.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return "", leaderError(err)
+	}
+
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].Key < pairs[j].Key
+	})
+
+	h := sha256.New()
+	for _, p := range pairs {
+		// length prefixes keep key/value boundaries unambiguous
+		fmt.Fprintf(h, "%d:%s%d:", len(p.Key), p.Key, len(p.Value))
+		h.Write(p.Value)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ListSince returns KVPairs under prefix modified after sinceIndex and the
+// max modify index seen, to be passed as sinceIndex on the next call.
+// Deleted keys are not reported.
+func (c *client) ListSince(prefix string, sinceIndex uint64) (consulapi.KVPairs, uint64, error) {
+	return c.ListSinceContext(context.Background(), prefix, sinceIndex)
+}
+
+// ListSinceContext is ListSince cancelled when ctx is done
+func (c *client) ListSinceContext(ctx context.Context, prefix string, sinceIndex uint64) (consulapi.KVPairs, uint64, error) {
+	pairs, _, err := c.kv.List(prefix, (&consulapi.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return nil, 0, leaderError(err)
+	}
+
+	maxIndex := sinceIndex
+	var res consulapi.KVPairs
+	for _, p := range pairs {
+		if p.ModifyIndex <= sinceIndex {
+			continue
+		}
+		res = append(res, p)
+		if p.ModifyIndex > maxIndex {
+			maxIndex = p.ModifyIndex
+		}
+	}
+	return res, maxIndex, nil
+}
+
+// maxTxnOps the number of operations consul accepts in a single transaction
+const maxTxnOps = 64
+
+// PutMulti puts all pairs using transactions of up to 64 operations, so
+// the write is atomic only when it fits in a single transaction. When a
+// transaction fails the returned ErrPartialWrite lists the keys written by
+// the previous ones.
+func (c *client) PutMulti(pairs map[string]string) (*consulapi.WriteMeta, error) {
+	return c.PutMultiContext(context.Background(), pairs)
+}
+
+// PutMultiContext is PutMulti cancelled when ctx is done, the transactions
+// committed before are kept and reported by ErrPartialWrite
+func (c *client) PutMultiContext(ctx context.Context, pairs map[string]string) (*consulapi.WriteMeta, error) {
+	keys := make([]string, 0, len(pairs))
+	for k := range pairs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	meta := &consulapi.WriteMeta{}
+	for start := 0; start < len(keys); start += maxTxnOps {
+		end := start + maxTxnOps
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		ops := make(consulapi.TxnOps, 0, end-start)
+		for _, k := range keys[start:end] {
+			ops = append(ops, &consulapi.TxnOp{
+				KV: &consulapi.KVTxnOp{Verb: consulapi.KVSet, Key: k, Value: []byte(pairs[k])},
+			})
+		}
+
+		qm, err := c.runTxn(ctx, ops)
+		if err != nil {
+			return nil, ErrPartialWrite{Written: keys[:start], Underlying: err}
+		}
+		meta.RequestTime += qm.RequestTime
+	}
+	return meta, nil
+}
+
+// runTxn runs ops in a single transaction, a rolled back transaction is
+// reported as an error
+func (c *client) runTxn(ctx context.Context, ops consulapi.TxnOps) (*consulapi.QueryMeta, error) {
+	ok, resp, meta, err := c.txn.Txn(ops, (&consulapi.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		whats := make([]string, 0, len(resp.Errors))
+		for _, e := range resp.Errors {
+			whats = append(whats, e.What)
+		}
+		return nil, fmt.Errorf("transaction rolled back: %s", strings.Join(whats, "; "))
+	}
+	return meta, nil
+}
+
+// ListWithFilterNote returns KVPairs under prefix and whether some of them
+// were filtered out by ACLs, so callers can detect incomplete config
+func (c *client) ListWithFilterNote(prefix string) (consulapi.KVPairs, bool, error) {
+	return c.ListWithFilterNoteContext(context.Background(), prefix)
+}
+
+// ListWithFilterNoteContext is ListWithFilterNote cancelled when ctx is done
+func (c *client) ListWithFilterNoteContext(ctx context.Context, prefix string) (consulapi.KVPairs, bool, error) {
+	pairs, meta, err := c.kv.List(prefix, (&consulapi.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return nil, false, leaderError(err)
+	}
+	return pairs, meta.ResultsFilteredByACLs, nil
+}
+
+type staleEntry struct {
+	kv *consulapi.KVPair
+	at time.Time
+}
+
+// GetStaleIfError is Get serving the last value read successfully, with
+// stale true, when consul can not be reached within the window set by
+// WithStaleIfError. Without the option it behaves like Get.
+func (c *client) GetStaleIfError(key string) (*consulapi.KVPair, bool, error) {
+	return c.GetStaleIfErrorContext(context.Background(), key)
+}
+
+// GetStaleIfErrorContext is GetStaleIfError cancelled when ctx is done, a
+// cancelled read is not served stale
+func (c *client) GetStaleIfErrorContext(ctx context.Context, key string) (*consulapi.KVPair, bool, error) {
+	kv, _, err := c.GetContext(ctx, key)
+	if err == nil {
+		if c.staleWindow > 0 {
+			c.staleMu.Lock()
+			c.stale[key] = staleEntry{kv: kv, at: time.Now()}
+			c.staleMu.Unlock()
+		}
+		return kv, false, nil
+	}
+
+	if ctx.Err() != nil {
+		return nil, false, ctx.Err()
+	}
+	if _, ok := err.(ErrKVNotFound); ok || c.staleWindow <= 0 {
+		c.staleMu.Lock()
+		delete(c.stale, key)
+		c.staleMu.Unlock()
+		return nil, false, err
+	}
+
+	c.staleMu.Lock()
+	e, ok := c.stale[key]
+	c.staleMu.Unlock()
+	if !ok || time.Since(e.at) > c.staleWindow {
+		return nil, false, err
+	}
+	return e.kv, true, nil
+}
+
+// FlagGzip marks a KVPair whose value is gzip compressed
+const FlagGzip uint64 = 1 << 0
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// GetStrAuto returns the string value of key, decompressing values marked
+// with FlagGzip or starting with the gzip magic bytes
+func (c *client) GetStrAuto(key string) (string, error) {
+	return c.GetStrAutoContext(context.Background(), key)
+}
+
+// GetStrAutoContext is GetStrAuto cancelled when ctx is done
+func (c *client) GetStrAutoContext(ctx context.Context, key string) (string, error) {
+	kv, _, err := c.GetContext(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	if kv.Flags&FlagGzip == 0 && !bytes.HasPrefix(kv.Value, gzipMagic) {
+		return string(trimBOM(kv.Value)), nil
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(kv.Value))
+	if err != nil {
+		return "", fmt.Errorf("decompress \"%s\": %w", key, err)
+	}
+	defer r.Close()
+	value, err := io.ReadAll(r)
+	if err != nil {
+		return "", fmt.Errorf("decompress \"%s\": %w", key, err)
+	}
+	return string(trimBOM(value)), nil
+}
+
+// GetBytesSize returns the byte size value of key, see parseByteSize
+func (c *client) GetBytesSize(key string) (int64, error) {
+	return c.GetBytesSizeContext(context.Background(), key)
+}
+
+// GetBytesSizeContext is GetBytesSize cancelled when ctx is done
+func (c *client) GetBytesSizeContext(ctx context.Context, key string) (int64, error) {
+	v, err := c.GetStrContext(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	return parseByteSize(v)
+}
+
+// byteUnits multipliers of the decimal and binary byte size units
+var byteUnits = map[string]float64{
+	"":    1,
+	"B":   1,
+	"KB":  1e3,
+	"MB":  1e6,
+	"GB":  1e9,
+	"TB":  1e12,
+	"KIB": 1 << 10,
+	"MIB": 1 << 20,
+	"GIB": 1 << 30,
+	"TIB": 1 << 40,
+}
+
+// parseByteSize parses a byte size like 512KB or 1.5GiB, KB, MB, GB and
+// TB are decimal units and KiB, MiB, GiB and TiB binary ones, units are
+// case-insensitive and a number alone is bytes
+func parseByteSize(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i < 0 {
+		i = len(s)
+	}
+	num, unit := s[:i], strings.ToUpper(strings.TrimSpace(s[i:]))
+
+	mult, ok := byteUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("invalid size \"%s\": unknown unit \"%s\"", s, s[i:])
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size \"%s\": %w", s, err)
+	}
+	size := n * mult
+	if size >= math.MaxInt64 {
+		return 0, fmt.Errorf("invalid size \"%s\": out of range", s)
+	}
+	if size != math.Trunc(size) {
+		return 0, fmt.Errorf("invalid size \"%s\": fraction of a byte", s)
+	}
+	return int64(size), nil
+}
+
+// GetStrChain returns the string value of the first existing key among
+// prefix/key for each prefix in order, an empty prefix looks up key
+// itself, e.g. GetStrChain("timeout", "tenant/42", "tenant/default", "").
+// ErrKVNotFound is returned when all of them miss.
+func (c *client) GetStrChain(key string, prefixes ...string) (string, error) {
+	return c.GetStrChainContext(context.Background(), key, prefixes...)
+}
+
+// GetStrChainContext is GetStrChain cancelled when ctx is done
+func (c *client) GetStrChainContext(ctx context.Context, key string, prefixes ...string) (string, error) {
+	for _, prefix := range prefixes {
+		path := key
+		if prefix != "" {
+			path = strings.TrimSuffix(prefix, "/") + "/" + key
+		}
+		kv, _, err := c.GetContext(ctx, path)
+		if err == nil {
+			return string(trimBOM(kv.Value)), nil
+		}
+		if _, ok := err.(ErrKVNotFound); !ok {
+			return "", err
+		}
+	}
+	return "", ErrKVNotFound{Key: key}
+}
+
+// maxUpdateAttempts the number of check-and-set writes Update attempts
+const maxUpdateAttempts = 10
+
+// Update sets key to the value returned by fn for its current value, empty
+// when absent, using a check-and-set write retried with the new current
+// value on conflict. It returns the committed value, the error of fn or
+// ErrUpdateConflict when all attempts conflicted.
+func (c *client) Update(key string, fn func(old string) (string, error)) (string, error) {
+	return c.UpdateContext(context.Background(), key, fn)
+}
+
+// UpdateContext is Update cancelled when ctx is done, including between
+// attempts. The actor set with WithActor is passed to the AuditHook.
+func (c *client) UpdateContext(ctx context.Context, key string, fn func(old string) (string, error)) (string, error) {
+	for i := 0; i < maxUpdateAttempts; i++ {
+		kv, _, err := c.kv.Get(key, (&consulapi.QueryOptions{}).WithContext(ctx))
+		if err != nil {
+			return "", leaderError(err)
+		}
+		var old string
+		// a zero index makes the write succeed only if the key is still absent
+		var index uint64
+		if kv != nil {
+			old = string(kv.Value)
+			index = kv.ModifyIndex
+		}
+
+		value, err := fn(old)
+		if err != nil {
+			return "", err
+		}
+		p := &consulapi.KVPair{Key: key, Value: []byte(value), ModifyIndex: index}
+		ok, _, err := c.kv.CAS(p, (&consulapi.WriteOptions{}).WithContext(ctx))
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			if c.audit != nil {
+				c.audit("put", key, value, actorFrom(ctx))
+			}
+			return value, nil
+		}
+	}
+	return "", fmt.Errorf("%w: \"%s\" after %d attempts", ErrUpdateConflict, key, maxUpdateAttempts)
+}
+
+// SwapValues atomically swaps the values of keyA and keyB with a
+// transaction checking both are unchanged since read, retried on conflict.
+// ErrKVNotFound is returned when either key is missing and
+// ErrUpdateConflict when all attempts conflicted.
+func (c *client) SwapValues(keyA, keyB string) error {
+	return c.SwapValuesContext(context.Background(), keyA, keyB)
+}
+
+// SwapValuesContext is SwapValues cancelled when ctx is done, the actor set
+// with WithActor is passed to the AuditHook
+func (c *client) SwapValuesContext(ctx context.Context, keyA, keyB string) error {
+	for i := 0; i < maxUpdateAttempts; i++ {
+		a, _, err := c.GetContext(ctx, keyA)
+		if err != nil {
+			return err
+		}
+		b, _, err := c.GetContext(ctx, keyB)
+		if err != nil {
+			return err
+		}
+
+		ops := consulapi.TxnOps{
+			{KV: &consulapi.KVTxnOp{Verb: consulapi.KVCAS, Key: keyA, Value: b.Value, Flags: b.Flags, Index: a.ModifyIndex}},
+			{KV: &consulapi.KVTxnOp{Verb: consulapi.KVCAS, Key: keyB, Value: a.Value, Flags: a.Flags, Index: b.ModifyIndex}},
+		}
+		ok, _, _, err := c.txn.Txn(ops, (&consulapi.QueryOptions{}).WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		if ok {
+			if c.audit != nil {
+				c.audit("put", keyA, string(b.Value), actorFrom(ctx))
+				c.audit("put", keyB, string(a.Value), actorFrom(ctx))
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: swap of \"%s\" and \"%s\" after %d attempts", ErrUpdateConflict, keyA, keyB, maxUpdateAttempts)
+}
+
+// KVStat metadata of a KVPair
+type KVStat struct {
+	CreateIndex uint64
+	ModifyIndex uint64
+	LockIndex   uint64
+	Flags       uint64
+	// Session holding the key, empty when not locked
+	Session string
+}
+
+// Stat returns the metadata of key, or ErrKVNotFound when it does not exist
+func (c *client) Stat(key string) (*KVStat, error) {
+	return c.StatContext(context.Background(), key)
+}
+
+// StatContext is Stat cancelled when ctx is done
+func (c *client) StatContext(ctx context.Context, key string) (*KVStat, error) {
+	kv, _, err := c.GetContext(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return &KVStat{
+		CreateIndex: kv.CreateIndex,
+		ModifyIndex: kv.ModifyIndex,
+		LockIndex:   kv.LockIndex,
+		Flags:       kv.Flags,
+		Session:     kv.Session,
+	}, nil
+}
@@ -0,0 +1,151 @@
+package consul
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// ErrLockNotAcquired the lock was held by another session for the whole
+// WithLockWait duration
+var ErrLockNotAcquired = errors.New("lock not acquired")
+
+// defaultLockTTL TTL of the session holding a lock
+const defaultLockTTL = 15 * time.Second
+
+// LockOption configures Lock
+type LockOption func(*lockOptions)
+
+type lockOptions struct {
+	ttl   time.Duration
+	value []byte
+	wait  time.Duration
+	ctx   context.Context
+}
+
+// WithLockTTL sets the TTL of the session holding the lock, defaults to
+// 15s. A holder which stops renewing it, e.g. crashed, loses the lock
+// after up to twice the TTL.
+func WithLockTTL(ttl time.Duration) LockOption {
+	return func(o *lockOptions) {
+		o.ttl = ttl
+	}
+}
+
+// WithLockValue sets the value of the lock key while held, e.g. the
+// identity of the holder
+func WithLockValue(value []byte) LockOption {
+	return func(o *lockOptions) {
+		o.value = value
+	}
+}
+
+// WithLockWait makes Lock give up with ErrLockNotAcquired when the lock is
+// not acquired within wait, Lock blocks until it is acquired otherwise
+func WithLockWait(wait time.Duration) LockOption {
+	return func(o *lockOptions) {
+		o.wait = wait
+	}
+}
+
+// WithLockContext makes Lock give up waiting for the lock when ctx is done
+// and return the error of ctx
+func WithLockContext(ctx context.Context) LockOption {
+	return func(o *lockOptions) {
+		o.ctx = ctx
+	}
+}
+
+// Lock a distributed lock held by a session of the client
+type Lock struct {
+	lock     *consulapi.Lock
+	cancel   context.CancelFunc
+	lost     chan struct{}
+	unlocked chan struct{}
+	once     sync.Once
+}
+
+// Lock acquires the lock on key with a session kept alive by the client,
+// blocking until it is acquired. The lock is held until Unlock or until
+// it is lost, as signaled by Lost.
+func (c *client) Lock(key string, opts ...LockOption) (*Lock, error) {
+	o := lockOptions{ttl: defaultLockTTL, ctx: context.Background()}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	sctx, cancel := context.WithCancel(context.Background())
+	session, sessionLost, err := c.SessionKeepAlive(sctx, o.ttl)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	lock, err := c.raw.LockOpts(&consulapi.LockOptions{
+		Key:          key,
+		Value:        o.value,
+		Session:      session,
+		LockTryOnce:  o.wait > 0,
+		LockWaitTime: o.wait,
+	})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	held, err := lock.Lock(o.ctx.Done())
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if held == nil {
+		cancel()
+		if err := o.ctx.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: \"%s\"", ErrLockNotAcquired, key)
+	}
+
+	l := &Lock{
+		lock:     lock,
+		cancel:   cancel,
+		lost:     make(chan struct{}),
+		unlocked: make(chan struct{}),
+	}
+	go func() {
+		select {
+		case <-held:
+		case <-sessionLost:
+		case <-l.unlocked:
+		}
+		// releasing the lock also ends held
+		select {
+		case <-l.unlocked:
+		default:
+			close(l.lost)
+		}
+	}()
+	return l, nil
+}
+
+// Lost returns a channel closed when the lock is lost without Unlock,
+// e.g. its session was invalidated or the agent was unreachable for longer
+// than the session TTL. Critical sections must stop then.
+func (l *Lock) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// Unlock releases the lock and destroys its session, calling it again is
+// a no-op
+func (l *Lock) Unlock() error {
+	var err error
+	l.once.Do(func() {
+		close(l.unlocked)
+		err = l.lock.Unlock()
+		l.cancel()
+	})
+	return err
+}
@@ -0,0 +1,71 @@
+package consul
+
+import (
+	"container/list"
+	"sync"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+const defaultMetaCacheSize = 1024
+
+// metaCache keeps the last QueryMeta of the most recently used keys,
+// evicting an entry only resets the starting index of a future watch
+type metaCache struct {
+	mu    sync.Mutex
+	size  int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type metaEntry struct {
+	key  string
+	meta *consulapi.QueryMeta
+}
+
+func newMetaCache(size int) *metaCache {
+	if size < 1 {
+		size = defaultMetaCacheSize
+	}
+	return &metaCache{
+		size:  size,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+func (m *metaCache) get(key string) (*consulapi.QueryMeta, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.items[key]
+	if !ok {
+		return nil, false
+	}
+	m.ll.MoveToFront(e)
+	return e.Value.(*metaEntry).meta, true
+}
+
+func (m *metaCache) set(key string, meta *consulapi.QueryMeta) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if e, ok := m.items[key]; ok {
+		e.Value.(*metaEntry).meta = meta
+		m.ll.MoveToFront(e)
+		return
+	}
+
+	m.items[key] = m.ll.PushFront(&metaEntry{key: key, meta: meta})
+	if m.ll.Len() > m.size {
+		e := m.ll.Back()
+		m.ll.Remove(e)
+		delete(m.items, e.Value.(*metaEntry).key)
+	}
+}
+
+func (m *metaCache) len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.ll.Len()
+}
@@ -0,0 +1,41 @@
+package consul
+
+import (
+	"fmt"
+	"testing"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/l-vitaly/gounit"
+)
+
+func TestMetaCacheBounded(t *testing.T) {
+	u := gounit.New(t)
+
+	m := newMetaCache(10)
+	for i := 0; i < 1000; i++ {
+		m.set(fmt.Sprintf("key-%d", i), &consulapi.QueryMeta{LastIndex: uint64(i)})
+	}
+	u.AssertEquals(10, m.len(), "")
+
+	_, ok := m.get("key-0")
+	u.AssertEquals(false, ok, "oldest key evicted")
+
+	meta, ok := m.get("key-999")
+	u.AssertEquals(true, ok, "newest key kept")
+	u.AssertEquals(uint64(999), meta.LastIndex, "")
+}
+
+func TestMetaCacheRecentlyUsedKept(t *testing.T) {
+	u := gounit.New(t)
+
+	m := newMetaCache(2)
+	m.set("a", &consulapi.QueryMeta{LastIndex: 1})
+	m.set("b", &consulapi.QueryMeta{LastIndex: 2})
+	m.get("a")
+	m.set("c", &consulapi.QueryMeta{LastIndex: 3})
+
+	_, ok := m.get("a")
+	u.AssertEquals(true, ok, "recently used key kept")
+	_, ok = m.get("b")
+	u.AssertEquals(false, ok, "least recently used key evicted")
+}
@@ -0,0 +1,71 @@
+package consul
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// MirrorToFile writes the value of key to the file at path with mode and
+// rewrites it on every change until ctx is done, e.g. to inject a secret
+// without a sidecar. Files are replaced atomically through a temporary file
+// in the same directory, so readers never see a partial value. The file is
+// removed while the key does not exist. It returns the error of a failed
+// write or query, or the error of ctx once done.
+func (c *client) MirrorToFile(ctx context.Context, key, path string, mode os.FileMode) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var kv *consulapi.KVPair
+	var writeErr error
+	err := c.blockingQuery(ctx, key, 0, func(q *consulapi.QueryOptions) (uint64, error) {
+		var meta *consulapi.QueryMeta
+		var err error
+		kv, meta, err = c.kv.Get(key, q)
+		if err != nil {
+			return 0, leaderError(err)
+		}
+		return meta.LastIndex, nil
+	}, func() {
+		if kv == nil {
+			writeErr = os.Remove(path)
+			if os.IsNotExist(writeErr) {
+				writeErr = nil
+			}
+		} else {
+			writeErr = writeFileAtomic(path, kv.Value, mode)
+		}
+		if writeErr != nil {
+			cancel()
+		}
+	})
+	if writeErr != nil {
+		return writeErr
+	}
+	return err
+}
+
+// writeFileAtomic replaces the file at path with data by renaming a
+// temporary file written next to it
+func writeFileAtomic(path string, data []byte, mode os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,89 @@
+package consul
+
+import (
+	"sync"
+)
+
+// Event a value received by a Multiplexer from one of its sources, e.g. a
+// *consulapi.KVPair from WatchGet or []*consulapi.ServiceEntry from
+// WatchServices
+type Event struct {
+	// Source name of the source the value was received from
+	Source string
+	// Value received
+	Value interface{}
+}
+
+// MuxSource a named watch channel fanned in by Multiplex
+type MuxSource struct {
+	name    string
+	forward func(done <-chan struct{}, emit func(interface{}) bool)
+}
+
+// Source names the watch channel ch for Multiplex
+func Source[T any](name string, ch <-chan T) MuxSource {
+	return MuxSource{
+		name: name,
+		forward: func(done <-chan struct{}, emit func(interface{}) bool) {
+			for {
+				select {
+				case v, ok := <-ch:
+					if !ok || !emit(v) {
+						return
+					}
+				case <-done:
+					return
+				}
+			}
+		},
+	}
+}
+
+// Multiplexer fans several watch channels into a single one
+type Multiplexer struct {
+	events chan Event
+	done   chan struct{}
+	once   sync.Once
+	wg     sync.WaitGroup
+}
+
+// Multiplex returns a Multiplexer emitting the values of every source as
+// an Event tagged with its name, e.g. to reload when either a feature flag
+// or a backend service set changes
+func Multiplex(sources ...MuxSource) *Multiplexer {
+	m := &Multiplexer{
+		events: make(chan Event),
+		done:   make(chan struct{}),
+	}
+	for _, src := range sources {
+		m.wg.Add(1)
+		go func(src MuxSource) {
+			defer m.wg.Done()
+			src.forward(m.done, func(v interface{}) bool {
+				select {
+				case m.events <- Event{Source: src.name, Value: v}:
+					return true
+				case <-m.done:
+					return false
+				}
+			})
+		}(src)
+	}
+	go func() {
+		m.wg.Wait()
+		close(m.events)
+	}()
+	return m
+}
+
+// Events returns the channel of the events of all sources, it is closed
+// once every source is closed or the Multiplexer is closed
+func (m *Multiplexer) Events() <-chan Event {
+	return m.events
+}
+
+// Close stops forwarding the sources, the watches behind them are stopped
+// by their own context
+func (m *Multiplexer) Close() {
+	m.once.Do(func() { close(m.done) })
+}
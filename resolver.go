@@ -0,0 +1,114 @@
+package consul
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// resolverRetryDelay first delay before re-establishing the failed watch of
+// a resolver, doubled on each failure up to resolverMaxRetryDelay
+const (
+	resolverRetryDelay    = time.Second
+	resolverMaxRetryDelay = 30 * time.Second
+)
+
+// ServiceResolver resolves a service to the host:port of its passing
+// instances, kept up to date by a background watch
+type ServiceResolver struct {
+	service string
+	cancel  context.CancelFunc
+	ready   chan struct{}
+
+	mu    sync.RWMutex
+	addrs []string
+	err   error
+}
+
+// Resolver returns a ServiceResolver of the passing instances of service
+// with the tag, Close stops its watch
+func (c *client) Resolver(service, tag string) *ServiceResolver {
+	return c.ResolverContext(context.Background(), service, tag)
+}
+
+// ResolverContext is Resolver whose watch also stops when ctx is done. A
+// failed watch is re-established with backoff, the last passing instances
+// are resolved meanwhile.
+func (c *client) ResolverContext(ctx context.Context, service, tag string) *ServiceResolver {
+	ctx, cancel := context.WithCancel(ctx)
+	r := &ServiceResolver{
+		service: service,
+		cancel:  cancel,
+		ready:   make(chan struct{}),
+	}
+	go func() {
+		var once sync.Once
+		ready := func() { once.Do(func() { close(r.ready) }) }
+		delay := resolverRetryDelay
+		for {
+			for entries := range c.WatchServices(ctx, service, tag) {
+				r.set(entries)
+				ready()
+				delay = resolverRetryDelay
+			}
+			if ctx.Err() != nil {
+				break
+			}
+
+			r.mu.Lock()
+			if r.addrs == nil {
+				// no passing instances known yet to resolve meanwhile
+				r.err = fmt.Errorf("watch of \"%s\" failed, retrying", service)
+			}
+			r.mu.Unlock()
+			ready()
+
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+			}
+			delay = min(2*delay, resolverMaxRetryDelay)
+		}
+		r.mu.Lock()
+		r.err = fmt.Errorf("resolver of \"%s\" stopped", service)
+		r.mu.Unlock()
+		ready()
+	}()
+	return r
+}
+
+func (r *ServiceResolver) set(entries []*consulapi.ServiceEntry) {
+	addrs := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		addrs = append(addrs, taggedAddress(entry, ""))
+	}
+	r.mu.Lock()
+	r.addrs = addrs
+	r.err = nil
+	r.mu.Unlock()
+}
+
+// Resolve returns host:port of the current passing instances, waiting for
+// the first watch result. ErrInsufficientInstances is returned when there
+// are none.
+func (r *ServiceResolver) Resolve() ([]string, error) {
+	<-r.ready
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if len(r.addrs) == 0 {
+		return nil, ErrInsufficientInstances{Service: r.service, Count: 0, Min: 1}
+	}
+	return append([]string(nil), r.addrs...), nil
+}
+
+// Close stops the watch of the resolver
+func (r *ServiceResolver) Close() {
+	r.cancel()
+}
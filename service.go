@@ -0,0 +1,882 @@
+package consul
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+const (
+	defaultCheckTTL                       = 3 * time.Second
+	defaultDeregisterCriticalServiceAfter = 10 * time.Second
+)
+
+// ServiceOptions options for RegisterServiceWithOptions
+type ServiceOptions struct {
+	// ID of the service, defaults to Name
+	ID string
+	// Name of the service
+	Name string
+	// Address of the service as host:port
+	Address string
+	// Tags of the service
+	Tags []string
+	// TaggedAddresses host:port of the service per network (e.g. lan, wan)
+	// for split-horizon networking, see GetServiceTaggedAddress
+	TaggedAddresses map[string]string
+	// Meta of the service
+	Meta map[string]string
+	// TTL of the service check, defaults to 3s, ignored when an HTTP, TCP
+	// or GRPC check is set
+	TTL time.Duration
+	// HTTP URL checked instead of a TTL check
+	HTTP string
+	// TCP host:port checked instead of a TTL check
+	TCP string
+	// GRPC host:port/service checked instead of a TTL check
+	GRPC string
+	// Interval of the HTTP, TCP or GRPC check
+	Interval time.Duration
+	// Timeout of the HTTP, TCP or GRPC check, must be less than Interval
+	Timeout time.Duration
+	// CheckID of the service check, defaults to service:<ID> as assigned by
+	// consul, e.g. to heartbeat a TTL check with PassTTL
+	CheckID string
+	// DeregisterCriticalServiceAfter defaults to 10s
+	DeregisterCriticalServiceAfter time.Duration
+	// Status initial status of the check, consul defaults to critical
+	Status string
+	// SuccessBeforePassing consecutive successful results required
+	// before the check becomes passing
+	SuccessBeforePassing int
+	// FailuresBeforeCritical consecutive failed results required
+	// before the check becomes critical
+	FailuresBeforeCritical int
+	// Connect configuration of the service, e.g. a sidecar proxy
+	Connect *consulapi.AgentServiceConnect
+}
+
+// Upstream a service exposed by the sidecar proxy on a local port
+type Upstream struct {
+	// DestinationName name of the upstream service
+	DestinationName string
+	// LocalBindPort port the proxy listens on for the upstream
+	LocalBindPort int
+}
+
+// RegisterServiceWithOptions a service with consul local agent
+func (c *client) RegisterServiceWithOptions(opts ServiceOptions) error {
+	return c.RegisterServiceWithOptionsContext(context.Background(), opts)
+}
+
+// RegisterServiceWithOptionsContext is RegisterServiceWithOptions cancelled
+// when ctx is done, including the wait set by WaitForRegistration
+func (c *client) RegisterServiceWithOptionsContext(ctx context.Context, opts ServiceOptions) error {
+	reg, err := opts.registration()
+	if err != nil {
+		return err
+	}
+	if err := c.agent.ServiceRegisterOpts(reg, consulapi.ServiceRegisterOpts{}.WithContext(ctx)); err != nil {
+		return err
+	}
+	c.recordOwn(reg)
+	if c.registrationWait > 0 {
+		return c.waitRegistered(ctx, reg.Name, reg.ID)
+	}
+	return nil
+}
+
+// registrationPollInterval how often waitRegistered polls the catalog
+const registrationPollInterval = 50 * time.Millisecond
+
+// waitRegistered polls the catalog until the instance id of service is
+// present. The local agent knows the service as soon as it is registered
+// but syncs it to the catalog asynchronously.
+func (c *client) waitRegistered(ctx context.Context, service, id string) error {
+	deadline := time.Now().Add(c.registrationWait)
+	q := (&consulapi.QueryOptions{Filter: fmt.Sprintf("Service.ID == %q", id)}).WithContext(ctx)
+	for {
+		addrs, _, err := c.health.Service(service, "", false, q)
+		if err == nil && len(addrs) > 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if err != nil {
+				return fmt.Errorf("%w: %s: %w", ErrRegistrationTimeout, id, err)
+			}
+			return fmt.Errorf("%w: %s", ErrRegistrationTimeout, id)
+		}
+		select {
+		case <-time.After(registrationPollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// RegisterServiceWithHeartbeat a service with a TTL check passed by the
+// Heartbeats manager of the client every half TTL, until the service is
+// deregistered with DeRegisterService
+func (c *client) RegisterServiceWithHeartbeat(opts ServiceOptions) error {
+	return c.RegisterServiceWithHeartbeatContext(context.Background(), opts)
+}
+
+// RegisterServiceWithHeartbeatContext is RegisterServiceWithHeartbeat
+// cancelled when ctx is done, the heartbeat outlives ctx
+func (c *client) RegisterServiceWithHeartbeatContext(ctx context.Context, opts ServiceOptions) error {
+	if opts.HTTP != "" || opts.TCP != "" || opts.GRPC != "" {
+		return fmt.Errorf("%w: heartbeat requires a TTL check", ErrInvalidCheckOptions)
+	}
+	ttl := opts.TTL
+	if ttl == 0 {
+		ttl = defaultCheckTTL
+	}
+	if ttl/2 <= 0 {
+		return fmt.Errorf("%w: TTL %s too short to heartbeat", ErrInvalidCheckOptions, ttl)
+	}
+	if err := c.RegisterServiceWithOptionsContext(ctx, opts); err != nil {
+		return err
+	}
+
+	id := opts.ID
+	if id == "" {
+		id = opts.Name
+	}
+	checkID := opts.CheckID
+	if checkID == "" {
+		checkID = "service:" + id
+	}
+
+	c.ownMu.Lock()
+	c.heartbeated[id] = checkID
+	c.ownMu.Unlock()
+	return c.heartbeats.Add(checkID, ttl/2)
+}
+
+// RegisterServiceForListener a service at the address ln is bound to, e.g.
+// the ephemeral port of a listener on :0. A listener on all interfaces
+// registers the address of the agent.
+func (c *client) RegisterServiceForListener(name string, ln net.Listener, tags ...string) error {
+	return c.RegisterServiceForListenerContext(context.Background(), name, ln, tags...)
+}
+
+// RegisterServiceForListenerContext is RegisterServiceForListener cancelled
+// when ctx is done
+func (c *client) RegisterServiceForListenerContext(ctx context.Context, name string, ln net.Listener, tags ...string) error {
+	addr, ok := ln.Addr().(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("%w: %s listener", ErrInvalidServiceAddr, ln.Addr().Network())
+	}
+	host := ""
+	if !addr.IP.IsUnspecified() {
+		host = addr.IP.String()
+	}
+	return c.RegisterServiceContext(ctx, name, net.JoinHostPort(host, strconv.Itoa(addr.Port)), tags...)
+}
+
+// RegisterHTTPService a service with an HTTP check of
+// http://<addr><healthPath> run every interval, timing out after half of it
+func (c *client) RegisterHTTPService(name, addr, healthPath string, interval time.Duration, tags ...string) error {
+	return c.RegisterHTTPServiceContext(context.Background(), name, addr, healthPath, interval, tags...)
+}
+
+// RegisterHTTPServiceContext is RegisterHTTPService cancelled when ctx is
+// done
+func (c *client) RegisterHTTPServiceContext(ctx context.Context, name, addr, healthPath string, interval time.Duration, tags ...string) error {
+	if !strings.HasPrefix(healthPath, "/") {
+		return fmt.Errorf("%w: health path \"%s\" must start with /", ErrInvalidCheckOptions, healthPath)
+	}
+	return c.RegisterServiceWithOptionsContext(ctx, ServiceOptions{
+		Name:     name,
+		Address:  addr,
+		Tags:     tags,
+		HTTP:     "http://" + addr + healthPath,
+		Interval: interval,
+		Timeout:  interval / 2,
+	})
+}
+
+// RegisterConnectService a service along with its Connect sidecar proxy
+func (c *client) RegisterConnectService(name string, addr string, upstreams []Upstream, tags ...string) error {
+	return c.RegisterConnectServiceContext(context.Background(), name, addr, upstreams, tags...)
+}
+
+// RegisterConnectServiceContext is RegisterConnectService cancelled when ctx
+// is done
+func (c *client) RegisterConnectServiceContext(ctx context.Context, name string, addr string, upstreams []Upstream, tags ...string) error {
+	proxyUpstreams := make([]consulapi.Upstream, 0, len(upstreams))
+	for _, u := range upstreams {
+		proxyUpstreams = append(proxyUpstreams, consulapi.Upstream{
+			DestinationType: consulapi.UpstreamDestTypeService,
+			DestinationName: u.DestinationName,
+			LocalBindPort:   u.LocalBindPort,
+		})
+	}
+
+	return c.RegisterServiceWithOptionsContext(ctx, ServiceOptions{
+		Name:    name,
+		Address: addr,
+		Tags:    tags,
+		Connect: &consulapi.AgentServiceConnect{
+			SidecarService: &consulapi.AgentServiceRegistration{
+				Proxy: &consulapi.AgentServiceConnectProxyConfig{
+					Upstreams: proxyUpstreams,
+				},
+			},
+		},
+	})
+}
+
+// PassTTL marks the TTL check checkID as passing with the note as output,
+// it must be called within the TTL to keep the check passing
+func (c *client) PassTTL(checkID string, note string) error {
+	return c.PassTTLContext(context.Background(), checkID, note)
+}
+
+// PassTTLContext is PassTTL cancelled when ctx is done
+func (c *client) PassTTLContext(ctx context.Context, checkID string, note string) error {
+	return c.agent.UpdateTTLOpts(checkID, note, consulapi.HealthPassing, (&consulapi.QueryOptions{}).WithContext(ctx))
+}
+
+// UpdateServiceTags replaces the tags of a service registered with the
+// local agent. The service is re-registered with its checks, which the
+// agent would remove otherwise, keeping their current status. The TTL and
+// thresholds of the checks are those registered by this client, a TTL
+// check registered elsewhere fails with ErrUnknownCheckTTL.
+func (c *client) UpdateServiceTags(serviceID string, tags []string) error {
+	return c.UpdateServiceTagsContext(context.Background(), serviceID, tags)
+}
+
+// UpdateServiceTagsContext is UpdateServiceTags cancelled when ctx is done
+func (c *client) UpdateServiceTagsContext(ctx context.Context, serviceID string, tags []string) error {
+	svc, _, err := c.agent.Service(serviceID, (&consulapi.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	checks, err := c.agent.ChecksWithFilterOpts("", (&consulapi.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return err
+	}
+
+	reg := serviceRegistration(svc)
+	reg.Tags = tags
+	checkIDs := make([]string, 0, len(checks))
+	for id, check := range checks {
+		if check.ServiceID == serviceID {
+			checkIDs = append(checkIDs, id)
+		}
+	}
+	sort.Strings(checkIDs)
+	for _, id := range checkIDs {
+		check, err := serviceCheck(checks[id], c.ownCheck(serviceID, id))
+		if err != nil {
+			return err
+		}
+		reg.Checks = append(reg.Checks, check)
+	}
+	if err := c.agent.ServiceRegisterOpts(reg, consulapi.ServiceRegisterOpts{}.WithContext(ctx)); err != nil {
+		return err
+	}
+	c.recordOwn(reg)
+	return nil
+}
+
+// ExportServices returns the services registered with the local agent
+// along with their checks as JSON, for ImportServices to restore them. A
+// TTL check not registered by this client fails with ErrUnknownCheckTTL.
+func (c *client) ExportServices() ([]byte, error) {
+	return c.ExportServicesContext(context.Background())
+}
+
+// ExportServicesContext is ExportServices cancelled when ctx is done
+func (c *client) ExportServicesContext(ctx context.Context) ([]byte, error) {
+	services, err := c.agent.ServicesWithFilterOpts("", (&consulapi.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	checks, err := c.agent.ChecksWithFilterOpts("", (&consulapi.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	regs := make([]*consulapi.AgentServiceRegistration, 0, len(services))
+	for _, svc := range services {
+		regs = append(regs, serviceRegistration(svc))
+	}
+	sort.Slice(regs, func(i, j int) bool {
+		return regs[i].ID < regs[j].ID
+	})
+
+	byID := make(map[string]*consulapi.AgentServiceRegistration, len(regs))
+	for _, reg := range regs {
+		byID[reg.ID] = reg
+	}
+	checkIDs := make([]string, 0, len(checks))
+	for id := range checks {
+		checkIDs = append(checkIDs, id)
+	}
+	sort.Strings(checkIDs)
+	for _, id := range checkIDs {
+		check := checks[id]
+		reg, ok := byID[check.ServiceID]
+		if !ok {
+			continue
+		}
+		sc, err := serviceCheck(check, c.ownCheck(check.ServiceID, id))
+		if err != nil {
+			return nil, err
+		}
+		reg.Checks = append(reg.Checks, sc)
+	}
+	return json.Marshal(regs)
+}
+
+// ImportServices registers with the local agent the services exported by
+// ExportServices, replacing those with the same ID
+func (c *client) ImportServices(data []byte) error {
+	return c.ImportServicesContext(context.Background(), data)
+}
+
+// ImportServicesContext is ImportServices cancelled when ctx is done, the
+// services registered before are kept
+func (c *client) ImportServicesContext(ctx context.Context, data []byte) error {
+	var regs []*consulapi.AgentServiceRegistration
+	if err := json.Unmarshal(data, &regs); err != nil {
+		return err
+	}
+	for _, reg := range regs {
+		if err := c.agent.ServiceRegisterOpts(reg, consulapi.ServiceRegisterOpts{}.WithContext(ctx)); err != nil {
+			return fmt.Errorf("register \"%s\": %w", reg.ID, err)
+		}
+		c.recordOwn(reg)
+	}
+	return nil
+}
+
+// serviceRegistration returns the registration of a service known to the
+// agent, without its checks
+func serviceRegistration(svc *consulapi.AgentService) *consulapi.AgentServiceRegistration {
+	weights := svc.Weights
+	return &consulapi.AgentServiceRegistration{
+		Kind:              svc.Kind,
+		ID:                svc.ID,
+		Name:              svc.Service,
+		Tags:              svc.Tags,
+		Port:              svc.Port,
+		Address:           svc.Address,
+		SocketPath:        svc.SocketPath,
+		TaggedAddresses:   svc.TaggedAddresses,
+		EnableTagOverride: svc.EnableTagOverride,
+		Meta:              svc.Meta,
+		Weights:           &weights,
+		Proxy:             svc.Proxy,
+		Connect:           svc.Connect,
+		Namespace:         svc.Namespace,
+		Partition:         svc.Partition,
+	}
+}
+
+// recordOwn records reg as registered by this client with its checks by
+// the ID the agent assigns them
+func (c *client) recordOwn(reg *consulapi.AgentServiceRegistration) {
+	var defs []*consulapi.AgentServiceCheck
+	if reg.Check != nil {
+		defs = append(defs, reg.Check)
+	}
+	defs = append(defs, reg.Checks...)
+
+	checks := make(map[string]*consulapi.AgentServiceCheck, len(defs))
+	for i, def := range defs {
+		id := def.CheckID
+		if id == "" {
+			id = "service:" + reg.ID
+			if len(defs) > 1 {
+				id += ":" + strconv.Itoa(i+1)
+			}
+		}
+		checks[id] = def
+	}
+
+	c.ownMu.Lock()
+	c.own[reg.ID] = checks
+	c.ownMu.Unlock()
+}
+
+// ownCheck returns the definition of the check checkID of the service
+// serviceID registered by this client, nil if registered elsewhere
+func (c *client) ownCheck(serviceID, checkID string) *consulapi.AgentServiceCheck {
+	c.ownMu.Lock()
+	defer c.ownMu.Unlock()
+	return c.own[serviceID][checkID]
+}
+
+// serviceCheck returns the definition of a check known to the agent with
+// its current status as the initial one. The agent does not report the TTL
+// and thresholds of a check, they are taken from def, the definition
+// registered by this client if any.
+func serviceCheck(check *consulapi.AgentCheck, def *consulapi.AgentServiceCheck) (*consulapi.AgentServiceCheck, error) {
+	known := check.Definition
+	sc := &consulapi.AgentServiceCheck{
+		CheckID:       check.CheckID,
+		Name:          check.Name,
+		Notes:         check.Notes,
+		Status:        check.Status,
+		HTTP:          known.HTTP,
+		Header:        known.Header,
+		Method:        known.Method,
+		Body:          known.Body,
+		TLSServerName: known.TLSServerName,
+		TLSSkipVerify: known.TLSSkipVerify,
+		TCP:           known.TCP,
+		TCPUseTLS:     known.TCPUseTLS,
+		UDP:           known.UDP,
+		GRPC:          known.GRPC,
+		GRPCUseTLS:    known.GRPCUseTLS,
+	}
+	if def != nil {
+		sc.SuccessBeforePassing = def.SuccessBeforePassing
+		sc.FailuresBeforeCritical = def.FailuresBeforeCritical
+	}
+	if check.Type == "ttl" {
+		if def == nil || def.TTL == "" {
+			return nil, fmt.Errorf("%w: check \"%s\" of \"%s\" not registered by this client",
+				ErrUnknownCheckTTL, check.CheckID, check.ServiceID)
+		}
+		sc.TTL = def.TTL
+	}
+	if known.IntervalDuration > 0 {
+		sc.Interval = known.IntervalDuration.String()
+	}
+	if known.TimeoutDuration > 0 {
+		sc.Timeout = known.TimeoutDuration.String()
+	}
+	if known.DeregisterCriticalServiceAfterDuration > 0 {
+		sc.DeregisterCriticalServiceAfter = known.DeregisterCriticalServiceAfterDuration.String()
+	}
+	return sc, nil
+}
+
+func (o ServiceOptions) registration() (*consulapi.AgentServiceRegistration, error) {
+	host, strPort, err := net.SplitHostPort(o.Address)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidServiceAddr, err)
+	}
+
+	port, err := strconv.Atoi(strPort)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidPort, err)
+	}
+
+	var taggedAddresses map[string]consulapi.ServiceAddress
+	for tag, addr := range o.TaggedAddresses {
+		host, strPort, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", ErrInvalidServiceAddr, tag, err)
+		}
+		port, err := strconv.Atoi(strPort)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", ErrInvalidPort, tag, err)
+		}
+		if taggedAddresses == nil {
+			taggedAddresses = make(map[string]consulapi.ServiceAddress, len(o.TaggedAddresses))
+		}
+		taggedAddresses[tag] = consulapi.ServiceAddress{Address: host, Port: port}
+	}
+
+	if o.SuccessBeforePassing < 0 || o.FailuresBeforeCritical < 0 {
+		return nil, fmt.Errorf("%w: thresholds must not be negative", ErrInvalidCheckOptions)
+	}
+
+	id := o.ID
+	if id == "" {
+		id = o.Name
+	}
+	deregisterAfter := o.DeregisterCriticalServiceAfter
+	if deregisterAfter == 0 {
+		deregisterAfter = defaultDeregisterCriticalServiceAfter
+	}
+
+	check := &consulapi.AgentServiceCheck{
+		CheckID:                        o.CheckID,
+		Status:                         o.Status,
+		DeregisterCriticalServiceAfter: deregisterAfter.String(),
+		SuccessBeforePassing:           o.SuccessBeforePassing,
+		FailuresBeforeCritical:         o.FailuresBeforeCritical,
+	}
+	if o.HTTP != "" || o.TCP != "" || o.GRPC != "" {
+		// a timeout not less than the interval makes the check never pass
+		if o.Interval <= 0 || o.Timeout <= 0 || o.Timeout >= o.Interval {
+			return nil, fmt.Errorf("%w: timeout %s must be positive and less than interval %s",
+				ErrInvalidCheckOptions, o.Timeout, o.Interval)
+		}
+		check.HTTP = o.HTTP
+		check.TCP = o.TCP
+		check.GRPC = o.GRPC
+		check.Interval = o.Interval.String()
+		check.Timeout = o.Timeout.String()
+	} else {
+		ttl := o.TTL
+		if ttl == 0 {
+			ttl = defaultCheckTTL
+		}
+		check.TTL = ttl.String()
+	}
+
+	return &consulapi.AgentServiceRegistration{
+		ID:              id,
+		Name:            o.Name,
+		Address:         host,
+		Port:            port,
+		Tags:            o.Tags,
+		TaggedAddresses: taggedAddresses,
+		Meta:            o.Meta,
+		Check:           check,
+		Connect:         o.Connect,
+	}, nil
+}
+
+// WaitOptions options for WaitForServicesOpts
+type WaitOptions struct {
+	// Tag only instances with the tag are counted
+	Tag string
+	// Filter expression applied by consul to the health query
+	Filter string
+	// Min number of instances to wait for, defaults to 1
+	Min int
+	// IncludeWarning count instances in warning state as available
+	IncludeWarning bool
+}
+
+// WaitForServices blocks until at least one passing instance of service
+// with the tag is registered or ctx is done
+func (c *client) WaitForServices(ctx context.Context, service string, tag string) ([]*consulapi.ServiceEntry, error) {
+	return c.WaitForServicesOpts(ctx, service, WaitOptions{Tag: tag})
+}
+
+// WaitForServicesOpts blocks until at least opts.Min instances of service
+// matching opts are available or ctx is done
+func (c *client) WaitForServicesOpts(ctx context.Context, service string, opts WaitOptions) ([]*consulapi.ServiceEntry, error) {
+	min := opts.Min
+	if min < 1 {
+		min = 1
+	}
+
+	var lastIndex uint64
+	for {
+		q := &consulapi.QueryOptions{WaitIndex: lastIndex, Filter: opts.Filter}
+		addrs, meta, err := c.health.Service(service, opts.Tag, !opts.IncludeWarning, q.WithContext(ctx))
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, leaderError(err)
+		}
+
+		addrs = availableServices(addrs, opts.IncludeWarning)
+		if len(addrs) >= min {
+			return addrs, nil
+		}
+		lastIndex = nextWaitIndex(lastIndex, meta.LastIndex)
+	}
+}
+
+// availableServices drops critical instances, a query that is not passing
+// only returns instances in any state
+func availableServices(addrs []*consulapi.ServiceEntry, includeWarning bool) []*consulapi.ServiceEntry {
+	if !includeWarning {
+		return addrs
+	}
+	res := make([]*consulapi.ServiceEntry, 0, len(addrs))
+	for _, addr := range addrs {
+		switch addr.Checks.AggregatedStatus() {
+		case consulapi.HealthPassing, consulapi.HealthWarning:
+			res = append(res, addr)
+		}
+	}
+	return res
+}
+
+// GetServicesAtIndex returns passing instances of several services queried
+// concurrently along with the max index observed. Consul has no multi
+// service read, so the result is only approximately consistent: callers can
+// compare the returned index with later reads to detect skew.
+func (c *client) GetServicesAtIndex(services []string, tag string) (map[string][]*consulapi.ServiceEntry, uint64, error) {
+	return c.GetServicesAtIndexContext(context.Background(), services, tag)
+}
+
+// GetServicesAtIndexContext is GetServicesAtIndex cancelled when ctx is done
+func (c *client) GetServicesAtIndexContext(ctx context.Context, services []string, tag string) (map[string][]*consulapi.ServiceEntry, uint64, error) {
+	type result struct {
+		service string
+		addrs   []*consulapi.ServiceEntry
+		index   uint64
+		err     error
+	}
+
+	results := make(chan result, len(services))
+	for _, service := range services {
+		go func(service string) {
+			addrs, meta, err := c.health.Service(service, tag, true, (&consulapi.QueryOptions{}).WithContext(ctx))
+			r := result{service: service, addrs: addrs, err: leaderError(err)}
+			if meta != nil {
+				r.index = meta.LastIndex
+			}
+			results <- r
+		}(service)
+	}
+
+	res := make(map[string][]*consulapi.ServiceEntry, len(services))
+	var maxIndex uint64
+	var err error
+	for range services {
+		r := <-results
+		if r.err != nil {
+			if err == nil {
+				err = r.err
+			}
+			continue
+		}
+		res[r.service] = r.addrs
+		if r.index > maxIndex {
+			maxIndex = r.index
+		}
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return res, maxIndex, nil
+}
+
+// GetServiceTaggedAddress returns host:port of each passing instance of
+// service using the tagged address addrTag (e.g. wan) of the service, then
+// of its node, falling back to the default address
+func (c *client) GetServiceTaggedAddress(service string, tag string, addrTag string) ([]string, error) {
+	return c.GetServiceTaggedAddressContext(context.Background(), service, tag, addrTag)
+}
+
+// GetServiceTaggedAddressContext is GetServiceTaggedAddress cancelled when
+// ctx is done
+func (c *client) GetServiceTaggedAddressContext(ctx context.Context, service string, tag string, addrTag string) ([]string, error) {
+	addrs, _, err := c.GetServicesContext(ctx, service, tag)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		res = append(res, taggedAddress(addr, addrTag))
+	}
+	return res, nil
+}
+
+func taggedAddress(addr *consulapi.ServiceEntry, addrTag string) string {
+	if ta, ok := addr.Service.TaggedAddresses[addrTag]; ok && ta.Address != "" {
+		return net.JoinHostPort(ta.Address, strconv.Itoa(ta.Port))
+	}
+	if host, ok := addr.Node.TaggedAddresses[addrTag]; ok && host != "" {
+		return net.JoinHostPort(host, strconv.Itoa(addr.Service.Port))
+	}
+	host := addr.Service.Address
+	if host == "" {
+		host = addr.Node.Address
+	}
+	return net.JoinHostPort(host, strconv.Itoa(addr.Service.Port))
+}
+
+// GetServicesWithFallback returns the passing instances of service with the
+// tag, or synthetic entries built from the fallback host:port list when
+// discovery fails for any reason, e.g. during a consul outage
+func (c *client) GetServicesWithFallback(service, tag string, fallback []string) ([]*consulapi.ServiceEntry, error) {
+	return c.GetServicesWithFallbackContext(context.Background(), service, tag, fallback)
+}
+
+// GetServicesWithFallbackContext is GetServicesWithFallback cancelled when
+// ctx is done, a cancelled query does not fall back
+func (c *client) GetServicesWithFallbackContext(ctx context.Context, service, tag string, fallback []string) ([]*consulapi.ServiceEntry, error) {
+	addrs, _, err := c.GetServicesContext(ctx, service, tag)
+	if err == nil {
+		return addrs, nil
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	entries := make([]*consulapi.ServiceEntry, 0, len(fallback))
+	for _, addr := range fallback {
+		host, strPort, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidServiceAddr, err)
+		}
+		port, err := strconv.Atoi(strPort)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidPort, err)
+		}
+		entries = append(entries, &consulapi.ServiceEntry{
+			Node: &consulapi.Node{},
+			Service: &consulapi.AgentService{
+				ID:      addr,
+				Service: service,
+				Address: host,
+				Port:    port,
+			},
+		})
+	}
+	return entries, nil
+}
+
+// GetServiceAddresses returns host:port of each passing instance of service
+func (c *client) GetServiceAddresses(service string, tag string) ([]string, error) {
+	return c.GetServiceAddressesMinContext(context.Background(), service, tag, 1)
+}
+
+// GetServiceAddressesContext is GetServiceAddresses cancelled when ctx is
+// done
+func (c *client) GetServiceAddressesContext(ctx context.Context, service string, tag string) ([]string, error) {
+	return c.GetServiceAddressesMinContext(ctx, service, tag, 1)
+}
+
+// GetServiceAddressesMin returns host:port of each passing instance of
+// service, or ErrInsufficientInstances when there are less than min
+func (c *client) GetServiceAddressesMin(service string, tag string, min int) ([]string, error) {
+	return c.GetServiceAddressesMinContext(context.Background(), service, tag, min)
+}
+
+// GetServiceAddressesMinContext is GetServiceAddressesMin cancelled when ctx
+// is done
+func (c *client) GetServiceAddressesMinContext(ctx context.Context, service string, tag string, min int) ([]string, error) {
+	addrs, _, err := c.health.Service(service, tag, true, (&consulapi.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return nil, leaderError(err)
+	}
+	if len(addrs) < min {
+		return nil, ErrInsufficientInstances{Service: service, Count: len(addrs), Min: min}
+	}
+	res := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		res = append(res, taggedAddress(addr, ""))
+	}
+	return res, nil
+}
+
+// GetWeightedRandomService returns a passing instance of service picked at
+// random proportionally to its weight, read from a tagKey=N tag
+// (e.g. weight=5), instances without a valid weight tag weigh 1
+func (c *client) GetWeightedRandomService(service string, tagKey string) (*consulapi.ServiceEntry, error) {
+	return c.GetWeightedRandomServiceContext(context.Background(), service, tagKey)
+}
+
+// GetWeightedRandomServiceContext is GetWeightedRandomService cancelled when
+// ctx is done
+func (c *client) GetWeightedRandomServiceContext(ctx context.Context, service string, tagKey string) (*consulapi.ServiceEntry, error) {
+	addrs, _, err := c.GetServicesContext(ctx, service, "")
+	if err != nil {
+		return nil, err
+	}
+
+	weights := make([]int, len(addrs))
+	total := 0
+	for i, addr := range addrs {
+		weights[i] = serviceWeight(addr.Service.Tags, tagKey)
+		total += weights[i]
+	}
+	if total == 0 {
+		return addrs[c.randIntn(len(addrs))], nil
+	}
+
+	n := c.randIntn(total)
+	for i, w := range weights {
+		if n < w {
+			return addrs[i], nil
+		}
+		n -= w
+	}
+	return addrs[len(addrs)-1], nil
+}
+
+func serviceWeight(tags []string, tagKey string) int {
+	prefix := tagKey + "="
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, prefix) {
+			continue
+		}
+		if w, err := strconv.Atoi(strings.TrimPrefix(tag, prefix)); err == nil && w >= 0 {
+			return w
+		}
+	}
+	return 1
+}
+
+func (c *client) randIntn(n int) int {
+	c.randMu.Lock()
+	defer c.randMu.Unlock()
+	return c.rand.Intn(n)
+}
+
+// DNSName returns the Consul DNS name of the service of entry, i.e.
+// <tag>.<service>.service.<dc>.consul, the tag and dc labels are omitted
+// when empty
+func DNSName(entry *consulapi.ServiceEntry, tag, dc string) string {
+	labels := make([]string, 0, 5)
+	if tag != "" {
+		labels = append(labels, tag)
+	}
+	labels = append(labels, entry.Service.Service, "service")
+	if dc != "" {
+		labels = append(labels, dc)
+	}
+	return strings.Join(append(labels, "consul"), ".")
+}
+
+// GetActiveColorService returns the passing instances of service tagged with
+// the active color read from colorKey (e.g. blue or green), for blue/green
+// deployments switched by writing the key
+func (c *client) GetActiveColorService(service, colorKey string) ([]*consulapi.ServiceEntry, error) {
+	return c.GetActiveColorServiceContext(context.Background(), service, colorKey)
+}
+
+// GetActiveColorServiceContext is GetActiveColorService cancelled when ctx
+// is done
+func (c *client) GetActiveColorServiceContext(ctx context.Context, service, colorKey string) ([]*consulapi.ServiceEntry, error) {
+	color, err := c.GetStrContext(ctx, colorKey)
+	if err != nil {
+		return nil, err
+	}
+	color = strings.TrimSpace(color)
+	if color == "" {
+		return nil, fmt.Errorf("no active color in \"%s\"", colorKey)
+	}
+	addrs, _, err := c.GetServicesContext(ctx, service, color)
+	return addrs, err
+}
+
+// ServiceTags returns the sorted union of the tags of all instances of
+// service, healthy or not
+func (c *client) ServiceTags(service string) ([]string, error) {
+	return c.ServiceTagsContext(context.Background(), service)
+}
+
+// ServiceTagsContext is ServiceTags cancelled when ctx is done
+func (c *client) ServiceTagsContext(ctx context.Context, service string) ([]string, error) {
+	addrs, _, err := c.health.Service(service, "", false, (&consulapi.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return nil, leaderError(err)
+	}
+	seen := make(map[string]bool)
+	tags := []string{}
+	for _, addr := range addrs {
+		for _, tag := range addr.Service.Tags {
+			if !seen[tag] {
+				seen[tag] = true
+				tags = append(tags, tag)
+			}
+		}
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
@@ -0,0 +1,145 @@
+package consul
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// SessionKeepAlive creates a session with the ttl and renews it until ctx
+// is done, the session is destroyed when ctx is done. The returned lost
+// channel is closed if the renewal fails, e.g. the session was invalidated
+// or the agent was unreachable for longer than the ttl.
+func (c *client) SessionKeepAlive(ctx context.Context, ttl time.Duration) (string, <-chan struct{}, error) {
+	entry := &consulapi.SessionEntry{
+		Name:     sessionName(),
+		TTL:      ttl.String(),
+		Behavior: consulapi.SessionBehaviorRelease,
+	}
+	id, _, err := c.session.Create(entry, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	c.trackSession(id, true)
+
+	lost := make(chan struct{})
+	go func() {
+		defer c.trackSession(id, false)
+		if err := c.session.RenewPeriodic(entry.TTL, id, nil, ctx.Done()); err != nil {
+			close(lost)
+		}
+	}()
+	return id, lost, nil
+}
+
+// sessionNamePrefix prefixes the owner and creation time in the name of
+// the sessions created by SessionKeepAlive
+const sessionNamePrefix = "l-vitaly/consul "
+
+// sessionName records the host and pid of the process renewing the session
+// and its creation time, see sessionOwnerDead
+func sessionName() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s%s %d %s", sessionNamePrefix, host, os.Getpid(),
+		time.Now().UTC().Format(time.RFC3339Nano))
+}
+
+// sessionOwnerDead reports whether the session name was created by a
+// process of this host which no longer runs, and the creation time. A
+// session of another host or of a process which may still run is never
+// reported dead: its renewal cannot be observed.
+func sessionOwnerDead(name string) (bool, time.Time) {
+	fields := strings.SplitN(strings.TrimPrefix(name, sessionNamePrefix), " ", 3)
+	if !strings.HasPrefix(name, sessionNamePrefix) || len(fields) != 3 {
+		return false, time.Time{}
+	}
+	created, err := time.Parse(time.RFC3339Nano, fields[2])
+	if err != nil {
+		return false, time.Time{}
+	}
+	pid, err := strconv.Atoi(fields[1])
+	if err != nil || pid <= 0 {
+		return false, created
+	}
+	if host, err := os.Hostname(); err != nil || host != fields[0] {
+		return false, created
+	}
+	if pid == os.Getpid() {
+		return false, created
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false, created
+	}
+	err = p.Signal(syscall.Signal(0))
+	return errors.Is(err, os.ErrProcessDone) || errors.Is(err, syscall.ESRCH), created
+}
+
+func (c *client) trackSession(id string, alive bool) {
+	c.sessionsMu.Lock()
+	defer c.sessionsMu.Unlock()
+	if alive {
+		c.sessions[id] = struct{}{}
+	} else {
+		delete(c.sessions, id)
+	}
+}
+
+// ListSessions returns all sessions of the datacenter
+func (c *client) ListSessions() ([]*consulapi.SessionEntry, error) {
+	return c.ListSessionsContext(context.Background())
+}
+
+// ListSessionsContext is ListSessions cancelled when ctx is done
+func (c *client) ListSessionsContext(ctx context.Context) ([]*consulapi.SessionEntry, error) {
+	sessions, _, err := c.session.List((&consulapi.QueryOptions{}).WithContext(ctx))
+	return sessions, err
+}
+
+// DestroyOrphanedSessions destroys the sessions created by SessionKeepAlive
+// more than olderThan ago whose renewing process is gone, e.g. crashed,
+// releasing their locks before their TTL expires. Only the sessions of
+// processes of this host can be proven gone, sessions of other hosts and of
+// live processes are kept. It returns the number of destroyed sessions.
+func (c *client) DestroyOrphanedSessions(olderThan time.Duration) (int, error) {
+	return c.DestroyOrphanedSessionsContext(context.Background(), olderThan)
+}
+
+// DestroyOrphanedSessionsContext is DestroyOrphanedSessions cancelled when
+// ctx is done, the sessions destroyed before are counted
+func (c *client) DestroyOrphanedSessionsContext(ctx context.Context, olderThan time.Duration) (int, error) {
+	sessions, err := c.ListSessionsContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	c.sessionsMu.Lock()
+	own := make(map[string]struct{}, len(c.sessions))
+	for id := range c.sessions {
+		own[id] = struct{}{}
+	}
+	c.sessionsMu.Unlock()
+
+	var destroyed int
+	for _, s := range sessions {
+		if _, ok := own[s.ID]; ok {
+			continue
+		}
+		dead, created := sessionOwnerDead(s.Name)
+		if !dead || time.Since(created) < olderThan {
+			continue
+		}
+		if _, err := c.session.Destroy(s.ID, (&consulapi.WriteOptions{}).WithContext(ctx)); err != nil {
+			return destroyed, err
+		}
+		destroyed++
+	}
+	return destroyed, nil
+}
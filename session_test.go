@@ -0,0 +1,32 @@
+package consul
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/l-vitaly/gounit"
+)
+
+func TestSessionOwnerDead(t *testing.T) {
+	u := gounit.New(t)
+
+	dead, _ := sessionOwnerDead(sessionName())
+	u.AssertEquals(false, dead, "session of this process")
+
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	u.AssertNotError(cmd.Run(), "")
+	host, _ := os.Hostname()
+	created := time.Now().UTC().Format(time.RFC3339Nano)
+
+	dead, _ = sessionOwnerDead(fmt.Sprintf("%s%s %d %s", sessionNamePrefix, host, cmd.Process.Pid, created))
+	u.AssertEquals(true, dead, "session of an exited process")
+
+	dead, _ = sessionOwnerDead(fmt.Sprintf("%sother-%s %d %s", sessionNamePrefix, host, cmd.Process.Pid, created))
+	u.AssertEquals(false, dead, "session of another host")
+
+	dead, _ = sessionOwnerDead(sessionNamePrefix + created)
+	u.AssertEquals(false, dead, "session without owner")
+}
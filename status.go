@@ -0,0 +1,52 @@
+package consul
+
+import (
+	"context"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+const defaultLeaderPollInterval = 5 * time.Second
+
+// WatchLeader polls the raft leader address, consul has no blocking leader
+// query, and emits it on start and whenever it changes. An empty address
+// means the cluster has no leader. Failed polls are skipped. The channel is
+// closed when ctx is done.
+func (c *client) WatchLeader(ctx context.Context) <-chan string {
+	interval := c.leaderPollInterval
+	if interval <= 0 {
+		interval = defaultLeaderPollInterval
+	}
+
+	ch := make(chan string)
+	go func() {
+		defer close(ch)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		var last string
+		first := true
+		for {
+			q := &consulapi.QueryOptions{}
+			leader, err := c.status.LeaderWithQueryOptions(q.WithContext(ctx))
+			if err == nil && (first || leader != last) {
+				first = false
+				last = leader
+				select {
+				case ch <- leader:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch
+}
@@ -0,0 +1,136 @@
+package consul
+
+import (
+	"context"
+	"encoding"
+	"reflect"
+	"time"
+)
+
+type structCacheKey struct {
+	parent string
+	typ    reflect.Type
+}
+
+type cachedStruct struct {
+	value   reflect.Value
+	expires time.Time
+}
+
+// CachedLoadStruct is LoadStruct serving the struct last loaded from parent
+// into the same type for ttl. The cache keeps its own deep copy and hands
+// out deep copies, so changes of i by the caller, including of its slices,
+// maps and pointers, do not leak into later loads.
+func (c *client) CachedLoadStruct(parent string, i interface{}, ttl time.Duration) error {
+	return c.CachedLoadStructContext(context.Background(), parent, i, ttl)
+}
+
+// CachedLoadStructContext is CachedLoadStruct cancelled when ctx is done
+func (c *client) CachedLoadStructContext(ctx context.Context, parent string, i interface{}, ttl time.Duration) error {
+	val := reflect.ValueOf(i).Elem()
+	key := structCacheKey{parent: parent, typ: val.Type()}
+
+	c.structCacheMu.Lock()
+	cached, ok := c.structCache[key]
+	c.structCacheMu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		val.Set(deepCopy(cached.value))
+		return nil
+	}
+
+	if err := c.LoadStructContext(ctx, parent, i); err != nil {
+		return err
+	}
+	value := deepCopy(val)
+
+	c.structCacheMu.Lock()
+	c.structCache[key] = cachedStruct{value: value, expires: time.Now().Add(ttl)}
+	c.structCacheMu.Unlock()
+	return nil
+}
+
+// deepCopy returns a copy of v sharing no memory reachable through its
+// exported fields, slices, maps, pointers and interfaces. Structs with
+// unexported fields, which reflection cannot copy, are copied by marshalling
+// them as text when they support it, e.g. big.Int.
+func deepCopy(v reflect.Value) reflect.Value {
+	cp := reflect.New(v.Type()).Elem()
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			cp.Set(reflect.New(v.Type().Elem()))
+			cp.Elem().Set(deepCopy(v.Elem()))
+		}
+	case reflect.Interface:
+		if !v.IsNil() {
+			cp.Set(deepCopy(v.Elem()))
+		}
+	case reflect.Slice:
+		if !v.IsNil() {
+			cp.Set(reflect.MakeSlice(v.Type(), v.Len(), v.Len()))
+			for i := 0; i < v.Len(); i++ {
+				cp.Index(i).Set(deepCopy(v.Index(i)))
+			}
+		}
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			cp.Index(i).Set(deepCopy(v.Index(i)))
+		}
+	case reflect.Map:
+		if !v.IsNil() {
+			cp.Set(reflect.MakeMapWithSize(v.Type(), v.Len()))
+			iter := v.MapRange()
+			for iter.Next() {
+				cp.SetMapIndex(deepCopy(iter.Key()), deepCopy(iter.Value()))
+			}
+		}
+	case reflect.Struct:
+		// time.Time only shares its immutable location
+		if v.Type() != timeType && hasUnexportedField(v.Type()) {
+			if c, ok := copyText(v); ok {
+				return c
+			}
+		}
+		cp.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			if cp.Field(i).CanSet() {
+				cp.Field(i).Set(deepCopy(v.Field(i)))
+			}
+		}
+	default:
+		cp.Set(v)
+	}
+	return cp
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func hasUnexportedField(typ reflect.Type) bool {
+	for i := 0; i < typ.NumField(); i++ {
+		if !typ.Field(i).IsExported() {
+			return true
+		}
+	}
+	return false
+}
+
+// copyText copies v by marshalling it as text when its type implements
+// both encoding.TextMarshaler and encoding.TextUnmarshaler
+func copyText(v reflect.Value) (reflect.Value, bool) {
+	src := reflect.New(v.Type())
+	src.Elem().Set(v)
+	m, ok := src.Interface().(encoding.TextMarshaler)
+	if !ok {
+		return reflect.Value{}, false
+	}
+	cp := reflect.New(v.Type())
+	u, ok := cp.Interface().(encoding.TextUnmarshaler)
+	if !ok {
+		return reflect.Value{}, false
+	}
+	text, err := m.MarshalText()
+	if err != nil || u.UnmarshalText(text) != nil {
+		return reflect.Value{}, false
+	}
+	return cp.Elem(), true
+}
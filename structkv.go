@@ -0,0 +1,237 @@
+package consul
+
+import (
+	"context"
+	"encoding"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// DiffStruct returns the KV paths under parent whose stored value differs
+// from the field of desired, formatted as LoadStruct reads them, including
+// paths which do not exist
+func (c *client) DiffStruct(parent string, desired interface{}) ([]string, error) {
+	return c.DiffStructContext(context.Background(), parent, desired)
+}
+
+// DiffStructContext is DiffStruct cancelled when ctx is done
+func (c *client) DiffStructContext(ctx context.Context, parent string, desired interface{}) ([]string, error) {
+	_, diff, err := c.diffStruct(ctx, parent, desired)
+	return diff, err
+}
+
+// ReconcileStruct writes the fields of desired which differ from the KV
+// tree under parent, using transactions, and returns their paths. Nothing
+// is written when the tree is in sync.
+func (c *client) ReconcileStruct(parent string, desired interface{}) ([]string, error) {
+	return c.ReconcileStructContext(context.Background(), parent, desired)
+}
+
+// ReconcileStructContext is ReconcileStruct cancelled when ctx is done
+func (c *client) ReconcileStructContext(ctx context.Context, parent string, desired interface{}) ([]string, error) {
+	want, diff, err := c.diffStruct(ctx, parent, desired)
+	if err != nil || len(diff) == 0 {
+		return nil, err
+	}
+
+	pairs := make(map[string]string, len(diff))
+	for _, path := range diff {
+		pairs[path] = want[path]
+	}
+	if _, err := c.PutMultiContext(ctx, pairs); err != nil {
+		return nil, err
+	}
+	return diff, nil
+}
+
+// diffStruct returns the values of the fields of desired by path and the
+// sorted paths whose stored value differs. Encrypted values are compared
+// decrypted and the differing ones returned encrypted, ready to write.
+func (c *client) diffStruct(ctx context.Context, parent string, desired interface{}) (map[string]string, []string, error) {
+	want := make(map[string]string)
+	encrypted := make(map[string]bool)
+	if err := c.structPairs(parent, reflect.Indirect(reflect.ValueOf(desired)), want, encrypted); err != nil {
+		return nil, nil, err
+	}
+
+	current, _, err := c.kv.List(parent, (&consulapi.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return nil, nil, leaderError(err)
+	}
+	have := make(map[string]string, len(current))
+	for _, p := range current {
+		value := p.Value
+		if encrypted[p.Key] {
+			// an undecryptable value is rewritten
+			if value, err = c.cipher.Decrypt(value); err != nil {
+				continue
+			}
+		}
+		have[p.Key] = string(value)
+	}
+
+	var diff []string
+	for path, v := range want {
+		if cur, ok := have[path]; !ok || cur != v {
+			diff = append(diff, path)
+		}
+	}
+	sort.Strings(diff)
+
+	for _, path := range diff {
+		if encrypted[path] {
+			if err := c.encryptPair(want, path); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return want, diff, nil
+}
+
+// SaveStruct writes the fields of i to the KVPairs under parent using
+// transactions, formatted as LoadStruct reads them and following the same
+// tags. Fields tagged encrypted are written encrypted.
+func (c *client) SaveStruct(parent string, i interface{}) error {
+	return c.SaveStructContext(context.Background(), parent, i)
+}
+
+// SaveStructContext is SaveStruct cancelled when ctx is done
+func (c *client) SaveStructContext(ctx context.Context, parent string, i interface{}) error {
+	pairs := make(map[string]string)
+	encrypted := make(map[string]bool)
+	if err := c.structPairs(parent, reflect.Indirect(reflect.ValueOf(i)), pairs, encrypted); err != nil {
+		return err
+	}
+	for path := range encrypted {
+		if err := c.encryptPair(pairs, path); err != nil {
+			return err
+		}
+	}
+	_, err := c.PutMultiContext(ctx, pairs)
+	return err
+}
+
+// encryptPair replaces the value of path in pairs with its ciphertext
+func (c *client) encryptPair(pairs map[string]string, path string) error {
+	value, err := c.cipher.Encrypt([]byte(pairs[path]))
+	if err != nil {
+		return fmt.Errorf("encrypt \"%s\": %w", path, err)
+	}
+	pairs[path] = string(value)
+	return nil
+}
+
+// structPairs adds the fields of val to pairs by KV path under parent,
+// formatted as recursiveLoadStruct parses them, and the paths of the fields
+// tagged encrypted to encrypted. Values are not encrypted.
+func (c *client) structPairs(parent string, val reflect.Value, pairs map[string]string, encrypted map[string]bool) error {
+	for i := 0; i < val.NumField(); i++ {
+		value := val.Field(i)
+		field := val.Type().Field(i)
+
+		var tagOptions map[string]string
+		if tag := field.Tag.Get("consul"); tag != "" {
+			var err error
+			tagOptions, err = c.getTagOptions(tag)
+			if err != nil {
+				return err
+			}
+		}
+
+		kvName, ok := tagOptions["name"]
+		if !ok {
+			kvName = strings.ToLower(field.Name)
+		}
+		path := fmt.Sprintf("%s/%s", parent, kvName)
+		enc, err := c.encrypted(tagOptions, path)
+		if err != nil {
+			return err
+		}
+		if enc {
+			encrypted[path] = true
+		}
+
+		if t, ok := value.Interface().(time.Time); ok {
+			layout, err := timeLayout(tagOptions)
+			if err != nil {
+				return fmt.Errorf("kv \"%s\": %w", path, err)
+			}
+			pairs[path] = t.Format(layout)
+		} else if isIPNet(field.Type) {
+			ipNet, ok := value.Interface().(*net.IPNet)
+			if !ok {
+				n := value.Interface().(net.IPNet)
+				ipNet = &n
+			}
+			if ipNet != nil {
+				pairs[path] = ipNet.String()
+			}
+		} else if m, ok := textMarshaler(value); ok {
+			text, err := m.MarshalText()
+			if err != nil {
+				return fmt.Errorf("kv \"%s\": %w", path, err)
+			}
+			pairs[path] = string(text)
+		} else if field.Type.Kind() == reflect.Struct {
+			if err := c.structPairs(path, value, pairs, encrypted); err != nil {
+				return err
+			}
+		} else {
+			s, err := formatValue(value)
+			if err != nil {
+				return fmt.Errorf("kv \"%s\": %w", path, err)
+			}
+			pairs[path] = s
+		}
+	}
+	return nil
+}
+
+func textMarshaler(value reflect.Value) (encoding.TextMarshaler, bool) {
+	if m, ok := value.Interface().(encoding.TextMarshaler); ok {
+		return m, true
+	}
+	if value.CanAddr() {
+		m, ok := value.Addr().Interface().(encoding.TextMarshaler)
+		return m, ok
+	}
+	return nil, false
+}
+
+// formatValue formats value as normalizeValue parses it
+func formatValue(value reflect.Value) (string, error) {
+	switch kind := value.Kind(); kind {
+	case reflect.String:
+		return value.String(), nil
+	case reflect.Bool:
+		return strconv.FormatBool(value.Bool()), nil
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(value.Float(), 'g', -1, value.Type().Bits()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if value.Type() == durationType {
+			return time.Duration(value.Int()).String(), nil
+		}
+		return strconv.FormatInt(value.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(value.Uint(), 10), nil
+	case reflect.Array:
+		parts := make([]string, value.Len())
+		for i := range parts {
+			s, err := formatValue(value.Index(i))
+			if err != nil {
+				return "", fmt.Errorf("element %d: %w", i, err)
+			}
+			parts[i] = s
+		}
+		return strings.Join(parts, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported type \"%s\"", kind.String())
+	}
+}
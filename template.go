@@ -0,0 +1,90 @@
+package consul
+
+import (
+	"context"
+	"strings"
+	"text/template"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// WatchTemplate renders the text/template tmpl, in which {{key "path"}}
+// is the value of a KVPair and empty when it does not exist, and passes the
+// result to out on start and whenever it changes. Exactly the keys read by
+// the last render are watched. It returns the error of a failed parse,
+// render or query, or the error of ctx once done.
+func (c *client) WatchTemplate(ctx context.Context, tmpl string, out func(rendered string)) error {
+	// indexes of the keys read by the current render
+	var indexes map[string]uint64
+	t, err := template.New("").Funcs(template.FuncMap{
+		"key": func(path string) (string, error) {
+			kv, meta, err := c.kv.Get(path, (&consulapi.QueryOptions{}).WithContext(ctx))
+			if err != nil {
+				return "", leaderError(err)
+			}
+			indexes[path] = meta.LastIndex
+			if kv == nil {
+				return "", nil
+			}
+			return string(kv.Value), nil
+		},
+	}).Parse(tmpl)
+	if err != nil {
+		return err
+	}
+
+	var last string
+	for i := 0; ; i++ {
+		indexes = make(map[string]uint64)
+		var buf strings.Builder
+		if err := t.Execute(&buf, nil); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		if rendered := buf.String(); i == 0 || rendered != last {
+			last = rendered
+			out(rendered)
+		}
+
+		if err := c.waitKeysChange(ctx, indexes); err != nil {
+			return err
+		}
+	}
+}
+
+// waitKeysChange blocks until one of the keys moves past its index, or
+// returns the error of a failed query or of ctx once done
+func (c *client) waitKeysChange(ctx context.Context, indexes map[string]uint64) error {
+	if len(indexes) == 0 {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	done := make(chan error, len(indexes))
+	for key, index := range indexes {
+		go func(key string, index uint64) {
+			done <- c.blockingQuery(wctx, key, index, func(q *consulapi.QueryOptions) (uint64, error) {
+				_, meta, err := c.kv.Get(key, q)
+				if err != nil {
+					return 0, leaderError(err)
+				}
+				return meta.LastIndex, nil
+			}, cancel)
+		}(key, index)
+	}
+
+	err := <-done
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err == context.Canceled {
+		// a key changed and cancelled the other watches
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,49 @@
+package test
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/l-vitaly/consul"
+	"github.com/l-vitaly/consul/testutil"
+	"github.com/l-vitaly/gounit"
+)
+
+func TestTokenSelf(t *testing.T) {
+	u := gounit.New(t)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(&consulapi.ACLToken{
+			AccessorID:  "6a1253d2-1785-24fd-91c2-f8e78c745511",
+			Description: "app token",
+			Policies:    []*consulapi.ACLTokenPolicyLink{{Name: "app-read"}},
+		})
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	token, err := client.TokenSelf()
+	u.AssertNotError(err, "")
+	u.AssertEquals("6a1253d2-1785-24fd-91c2-f8e78c745511", token.AccessorID, "")
+	u.AssertEquals("app-read", token.Policies[0].Name, "")
+}
+
+func TestTokenSelfACLDisabled(t *testing.T) {
+	u := gounit.New(t)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "ACL support disabled", http.StatusUnauthorized)
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	_, err = client.TokenSelf()
+	u.AssertEquals(true, errors.Is(err, consul.ErrFeatureUnavailable), "errors.Is ErrFeatureUnavailable")
+}
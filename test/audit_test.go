@@ -0,0 +1,102 @@
+package test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/l-vitaly/consul"
+	"github.com/l-vitaly/consul/testutil"
+	"github.com/l-vitaly/gounit"
+)
+
+func TestAuditHook(t *testing.T) {
+	u := gounit.New(t)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("true"))
+	})
+
+	var records [][4]string
+	hook := func(op, key, value, actor string) {
+		records = append(records, [4]string{op, key, value, actor})
+	}
+
+	client, srv, err := testutil.NewStubClient(handler, consul.WithAuditHook(hook))
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	ctx := consul.WithActor(context.Background(), "alice")
+	_, err = client.PutContext(ctx, "service/name", "api")
+	u.AssertNotError(err, "")
+	_, err = client.DeleteContext(ctx, "service/name")
+	u.AssertNotError(err, "")
+	_, err = client.Put("service/port", "80")
+	u.AssertNotError(err, "")
+
+	u.AssertEquals(3, len(records), "")
+	u.AssertEquals([4]string{"put", "service/name", "api", "alice"}, records[0], "")
+	u.AssertEquals([4]string{"delete", "service/name", "", "alice"}, records[1], "")
+	u.AssertEquals([4]string{"put", "service/port", "80", ""}, records[2], "no actor without WithActor")
+}
+
+func TestAuditHookUpdate(t *testing.T) {
+	u := gounit.New(t)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("true"))
+	})
+
+	var records [][4]string
+	hook := func(op, key, value, actor string) {
+		records = append(records, [4]string{op, key, value, actor})
+	}
+
+	client, srv, err := testutil.NewStubClient(handler, consul.WithAuditHook(hook))
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	ctx := consul.WithActor(context.Background(), "alice")
+	_, err = client.UpdateContext(ctx, "service/replicas", func(old string) (string, error) {
+		return "3", nil
+	})
+	u.AssertNotError(err, "")
+
+	u.AssertEquals(1, len(records), "")
+	u.AssertEquals([4]string{"put", "service/replicas", "3", "alice"}, records[0], "")
+}
+
+func TestAuditHookSwapValues(t *testing.T) {
+	u := gounit.New(t)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/kv/active":
+			w.Write(stubKVPair("active", "blue", 10))
+		case "/v1/kv/standby":
+			w.Write(stubKVPair("standby", "green", 11))
+		case "/v1/txn":
+			w.Write([]byte(`{"Results":[],"Errors":null}`))
+		}
+	})
+
+	var records [][4]string
+	hook := func(op, key, value, actor string) {
+		records = append(records, [4]string{op, key, value, actor})
+	}
+
+	client, srv, err := testutil.NewStubClient(handler, consul.WithAuditHook(hook))
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	ctx := consul.WithActor(context.Background(), "alice")
+	u.AssertNotError(client.SwapValuesContext(ctx, "active", "standby"), "")
+
+	u.AssertEquals(2, len(records), "")
+	u.AssertEquals([4]string{"put", "active", "green", "alice"}, records[0], "")
+	u.AssertEquals([4]string{"put", "standby", "blue", "alice"}, records[1], "")
+}
@@ -0,0 +1,64 @@
+package test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/l-vitaly/gounit"
+)
+
+func TestBarrier(t *testing.T) {
+	u := gounit.New(t)
+
+	prefix := testKey()
+
+	client, err := makeTestClient()
+	u.AssertNotError(err, "")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const workers = 3
+	var mu sync.Mutex
+	var passed int
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// workers arrive one after another
+			time.Sleep(time.Duration(i) * 200 * time.Millisecond)
+			mu.Lock()
+			early := passed
+			mu.Unlock()
+			if early > 0 {
+				t.Errorf("worker passed before worker %d arrived", i)
+			}
+			if err := client.Barrier(ctx, prefix, workers); err != nil {
+				errs <- err
+				return
+			}
+			mu.Lock()
+			passed++
+			mu.Unlock()
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		u.AssertNotError(err, "")
+	}
+	u.AssertEquals(workers, passed, "all workers passed")
+
+	keys, _, err := client.Raw().KV().Keys(prefix+"/", "", nil)
+	u.AssertNotError(err, "")
+	u.AssertEquals(0, len(keys), "keys cleaned up")
+
+	short, cancelShort := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancelShort()
+	err = client.Barrier(short, prefix, 2)
+	u.AssertEquals(context.DeadlineExceeded, err, "blocks until enough workers")
+}
@@ -1,11 +1,25 @@
 package test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	crand "crypto/rand"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/google/uuid"
+	consulapi "github.com/hashicorp/consul/api"
 	"github.com/l-vitaly/consul"
 	"github.com/l-vitaly/consul/testutil"
 	"github.com/l-vitaly/gounit"
@@ -119,3 +133,1796 @@ func TestWatchGet(t *testing.T) {
 	u.AssertNotNil(kv, "key/value")
 	u.AssertEquals(value, string(kv.Value), "")
 }
+
+func stubKVPair(key, value string, index uint64) []byte {
+	body, err := json.Marshal([]*consulapi.KVPair{{
+		Key:         key,
+		Value:       []byte(value),
+		CreateIndex: index,
+		ModifyIndex: index,
+	}})
+	if err != nil {
+		panic(err)
+	}
+	return body
+}
+
+func TestWatchGetIndexRollback(t *testing.T) {
+	u := gounit.New(t)
+
+	key := testKey()
+
+	var mu sync.Mutex
+	var waitIndexes []string
+	var calls int
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		call := calls
+		waitIndexes = append(waitIndexes, r.URL.Query().Get("index"))
+		mu.Unlock()
+
+		switch call {
+		case 1:
+			w.Header().Set("X-Consul-Index", "100")
+			w.Write(stubKVPair(key, "before", 100))
+		case 2:
+			// server restored from a snapshot, the index went backwards
+			w.Header().Set("X-Consul-Index", "5")
+			w.Write(stubKVPair(key, "after", 5))
+		default:
+			if call > 3 {
+				time.Sleep(50 * time.Millisecond)
+			}
+			w.Header().Set("X-Consul-Index", "5")
+			w.Write(stubKVPair(key, "after", 5))
+		}
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	ch := client.WatchGet(key)
+
+	for _, expected := range []string{"before", "after"} {
+		select {
+		case kv := <-ch:
+			u.AssertNotNil(kv, "key/value")
+			u.AssertEquals(expected, string(kv.Value), "")
+		case <-time.After(5 * time.Second):
+			t.Fatalf("watch did not recover, expected %q", expected)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	u.AssertEquals("100", waitIndexes[1], "wait index before rollback")
+	u.AssertEquals("", waitIndexes[2], "wait index reset after rollback")
+}
+
+func TestGobRoundTrip(t *testing.T) {
+	u := gounit.New(t)
+
+	key := testKey()
+
+	client, err := makeTestClient()
+	u.AssertNotError(err, "")
+
+	type state struct {
+		Name   string
+		Limits map[string]int
+		Hosts  []string
+	}
+
+	in := state{
+		Name:   "worker",
+		Limits: map[string]int{"cpu": 2, "mem": 512},
+		Hosts:  []string{"10.0.0.1", "10.0.0.2"},
+	}
+
+	err = client.PutGob(key, in)
+	u.AssertNotError(err, "put gob")
+
+	var out state
+	err = client.GetGob(key, &out)
+	u.AssertNotError(err, "get gob")
+	u.AssertEquals(in, out, "")
+}
+
+func TestTreeChecksum(t *testing.T) {
+	u := gounit.New(t)
+
+	prefix := testKey()
+
+	client, err := makeTestClient()
+	u.AssertNotError(err, "")
+
+	_, err = client.Put(prefix+"/a", "1")
+	u.AssertNotError(err, "")
+
+	before, err := client.TreeChecksum(prefix)
+	u.AssertNotError(err, "")
+
+	again, err := client.TreeChecksum(prefix)
+	u.AssertNotError(err, "")
+	u.AssertEquals(before, again, "checksum is stable")
+
+	_, err = client.Put(prefix+"/b", "2")
+	u.AssertNotError(err, "")
+
+	after, err := client.TreeChecksum(prefix)
+	u.AssertNotError(err, "")
+	if before == after {
+		t.Fatal("checksum did not change after put")
+	}
+}
+
+func TestGetBoolPermissive(t *testing.T) {
+	u := gounit.New(t)
+
+	prefix := testKey()
+
+	strict, err := makeTestClient()
+	u.AssertNotError(err, "")
+
+	client, err := testutil.NewClient(consul.WithPermissiveBool())
+	u.AssertNotError(err, "")
+
+	values := map[string]bool{"yes": true, "ON": true, "No": false, "off": false, "true": true}
+	for value, expected := range values {
+		key := prefix + "/" + value
+		_, err = client.Put(key, value)
+		u.AssertNotError(err, "")
+
+		b, err := client.GetBool(key)
+		u.AssertNotError(err, value)
+		u.AssertEquals(expected, b, value)
+	}
+
+	_, err = strict.GetBool(prefix + "/yes")
+	if err == nil {
+		t.Fatal("strict client accepted \"yes\"")
+	}
+
+	_, err = client.Put(prefix+"/config/enabled", "on")
+	u.AssertNotError(err, "")
+
+	var s struct {
+		Enabled bool
+	}
+	err = client.LoadStruct(prefix+"/config", &s)
+	u.AssertNotError(err, "")
+	u.AssertEquals(true, s.Enabled, "")
+}
+
+func TestListSince(t *testing.T) {
+	u := gounit.New(t)
+
+	prefix := testKey()
+
+	client, err := makeTestClient()
+	u.AssertNotError(err, "")
+
+	_, err = client.Put(prefix+"/old", "1")
+	u.AssertNotError(err, "")
+
+	pairs, index, err := client.ListSince(prefix, 0)
+	u.AssertNotError(err, "")
+	u.AssertEquals(1, len(pairs), "")
+
+	_, err = client.Put(prefix+"/new", "2")
+	u.AssertNotError(err, "")
+
+	pairs, next, err := client.ListSince(prefix, index)
+	u.AssertNotError(err, "")
+	u.AssertEquals(1, len(pairs), "")
+	u.AssertEquals(prefix+"/new", pairs[0].Key, "")
+	u.AssertEquals(pairs[0].ModifyIndex, next, "")
+}
+
+func TestLoadStructFieldParseError(t *testing.T) {
+	u := gounit.New(t)
+
+	prefix := testKey()
+
+	client, err := makeTestClient()
+	u.AssertNotError(err, "")
+
+	_, err = client.Put(prefix+"/offset", "ten")
+	u.AssertNotError(err, "")
+
+	var s struct {
+		Offset int
+	}
+	err = client.LoadStruct(prefix, &s)
+
+	var parseErr consul.ErrFieldParse
+	u.AssertEquals(true, errors.As(err, &parseErr), "errors.As ErrFieldParse")
+	u.AssertEquals(prefix+"/offset", parseErr.Path, "")
+	u.AssertEquals(true, errors.Is(err, strconv.ErrSyntax), "underlying error")
+	u.AssertEquals(true, strings.Contains(err.Error(), prefix+"/offset"), "message contains path")
+}
+
+func TestGetEventual(t *testing.T) {
+	u := gounit.New(t)
+
+	key := testKey()
+
+	var mu sync.Mutex
+	var calls int
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		call := calls
+		mu.Unlock()
+
+		w.Header().Set("X-Consul-Index", "10")
+		if call == 1 {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(stubKVPair(key, "value", 10))
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	kv, _, err := client.GetEventual(key, 3, 10*time.Millisecond)
+	u.AssertNotError(err, "")
+	u.AssertEquals("value", string(kv.Value), "")
+	u.AssertEquals(2, calls, "calls")
+
+	calls = 0
+	_, _, err = client.GetEventual(key, 1, 10*time.Millisecond)
+	_, ok := err.(consul.ErrKVNotFound)
+	u.AssertEquals(true, ok, "not found after last attempt")
+}
+
+func TestPutMulti(t *testing.T) {
+	u := gounit.New(t)
+
+	prefix := testKey()
+
+	client, err := makeTestClient()
+	u.AssertNotError(err, "")
+
+	pairs := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		pairs[fmt.Sprintf("%s/key-%03d", prefix, i)] = strconv.Itoa(i)
+	}
+
+	_, err = client.PutMulti(pairs)
+	u.AssertNotError(err, "")
+
+	for k, v := range pairs {
+		got, err := client.GetStr(k)
+		u.AssertNotError(err, k)
+		u.AssertEquals(v, got, k)
+	}
+}
+
+func TestListWithFilterNote(t *testing.T) {
+	u := gounit.New(t)
+
+	prefix := testKey()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Consul-Index", "10")
+		w.Header().Set("X-Consul-Results-Filtered-By-ACLs", "true")
+		w.Write(stubKVPair(prefix+"/visible", "value", 10))
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	pairs, filtered, err := client.ListWithFilterNote(prefix)
+	u.AssertNotError(err, "")
+	u.AssertEquals(1, len(pairs), "")
+	u.AssertEquals(true, filtered, "filtered by ACLs")
+}
+
+type Level uint8
+
+type Env string
+
+func TestLoadStructNamedTypes(t *testing.T) {
+	u := gounit.New(t)
+
+	prefix := testKey()
+
+	client, err := makeTestClient()
+	u.AssertNotError(err, "")
+
+	_, err = client.Put(prefix+"/level", "3")
+	u.AssertNotError(err, "")
+	_, err = client.Put(prefix+"/env", "prod")
+	u.AssertNotError(err, "")
+
+	var s struct {
+		Level Level
+		Env   Env
+	}
+	err = client.LoadStruct(prefix, &s)
+	u.AssertNotError(err, "")
+	u.AssertEquals(Level(3), s.Level, "")
+	u.AssertEquals(Env("prod"), s.Env, "")
+}
+
+type ID int
+
+type Host string
+
+type Ratio float64
+
+type Weight float32
+
+func TestLoadStructDefinedTypes(t *testing.T) {
+	u := gounit.New(t)
+
+	prefix := testKey()
+
+	client, err := makeTestClient()
+	u.AssertNotError(err, "")
+
+	values := map[string]string{"id": "42", "host": "db.local", "ratio": "0.75", "weight": "1.5"}
+	for k, v := range values {
+		_, err = client.Put(prefix+"/"+k, v)
+		u.AssertNotError(err, k)
+	}
+
+	var s struct {
+		ID     ID
+		Host   Host
+		Ratio  Ratio
+		Weight Weight
+	}
+	err = client.LoadStruct(prefix, &s)
+	u.AssertNotError(err, "")
+	u.AssertEquals(ID(42), s.ID, "")
+	u.AssertEquals(Host("db.local"), s.Host, "")
+	u.AssertEquals(Ratio(0.75), s.Ratio, "")
+	u.AssertEquals(Weight(1.5), s.Weight, "")
+}
+
+func TestWatchGetEventsDelete(t *testing.T) {
+	u := gounit.New(t)
+
+	key := testKey()
+
+	client, err := makeTestClient()
+	u.AssertNotError(err, "")
+
+	_, err = client.Put(key, "value")
+	u.AssertNotError(err, "")
+
+	ch := client.WatchGetEvents(key)
+
+	next := func() consul.KVEvent {
+		select {
+		case e := <-ch:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event emitted")
+		}
+		return consul.KVEvent{}
+	}
+
+	put := next()
+	u.AssertNotNil(put.KV, "key/value")
+
+	_, err = client.Delete(key)
+	u.AssertNotError(err, "")
+
+	deleted := next()
+	u.AssertEquals(true, deleted.KV == nil, "deleted key/value")
+	u.AssertEquals(true, deleted.Index > put.Index, "index advanced")
+}
+
+func TestGetIntOrDefaultEmpty(t *testing.T) {
+	u := gounit.New(t)
+
+	key := testKey()
+
+	client, err := makeTestClient()
+	u.AssertNotError(err, "")
+
+	_, err = client.Put(key, "  ")
+	u.AssertNotError(err, "")
+
+	n, err := client.GetIntOrDefault(key, 7)
+	u.AssertNotError(err, "")
+	u.AssertEquals(7, n, "")
+
+	_, err = client.GetInt(key)
+	if err == nil {
+		t.Fatal("strict GetInt accepted an empty value")
+	}
+
+	_, err = client.Put(key, "3")
+	u.AssertNotError(err, "")
+
+	n, err = client.GetIntOrDefault(key, 7)
+	u.AssertNotError(err, "")
+	u.AssertEquals(3, n, "")
+}
+
+func TestLoadStructDefaultInterpolation(t *testing.T) {
+	u := gounit.New(t)
+
+	prefix := testKey()
+
+	client, err := makeTestClient()
+	u.AssertNotError(err, "")
+
+	_, err = client.Put(prefix+"/name", "billing")
+	u.AssertNotError(err, "")
+
+	var s struct {
+		Name    string
+		Service string `consul:"default:${Name}-service"`
+	}
+	err = client.LoadStruct(prefix, &s)
+	u.AssertNotError(err, "")
+	u.AssertEquals("billing-service", s.Service, "")
+
+	var undefined struct {
+		Service string `consul:"default:${Missing}-service"`
+	}
+	err = client.LoadStruct(prefix, &undefined)
+	if err == nil || !strings.Contains(err.Error(), "${Missing}") {
+		t.Fatalf("expected undefined reference error, got %v", err)
+	}
+}
+
+func TestLoadStructConsistent(t *testing.T) {
+	u := gounit.New(t)
+
+	var mu sync.Mutex
+	var queries, consistent int
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		queries++
+		if r.URL.Query().Has("consistent") {
+			consistent++
+		}
+		mu.Unlock()
+
+		w.Header().Set("X-Consul-Index", "10")
+		http.NotFound(w, r)
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	var s struct {
+		Name   string `consul:"default:name"`
+		Nested struct {
+			Size int `consul:"default:1"`
+		}
+	}
+	err = client.LoadStructWithOptions("service", &s, consul.LoadOptions{Consistent: true})
+	u.AssertNotError(err, "")
+
+	mu.Lock()
+	defer mu.Unlock()
+	u.AssertEquals(2, queries, "queries")
+	u.AssertEquals(queries, consistent, "consistent queries")
+}
+
+func TestGetStaleIfError(t *testing.T) {
+	u := gounit.New(t)
+
+	key := testKey()
+
+	var mu sync.Mutex
+	failing := false
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failing {
+			http.Error(w, "rpc error: no leader", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("X-Consul-Index", "10")
+		w.Write(stubKVPair(key, "good", 10))
+	})
+
+	client, srv, err := testutil.NewStubClient(handler, consul.WithStaleIfError(time.Minute))
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	kv, stale, err := client.GetStaleIfError(key)
+	u.AssertNotError(err, "")
+	u.AssertEquals("good", string(kv.Value), "")
+	u.AssertEquals(false, stale, "fresh value")
+
+	mu.Lock()
+	failing = true
+	mu.Unlock()
+
+	kv, stale, err = client.GetStaleIfError(key)
+	u.AssertNotError(err, "")
+	u.AssertEquals("good", string(kv.Value), "")
+	u.AssertEquals(true, stale, "stale value")
+
+	_, _, err = client.GetStaleIfError(testKey())
+	if err == nil {
+		t.Fatal("served a key never read")
+	}
+}
+
+func TestKVHandle(t *testing.T) {
+	u := gounit.New(t)
+
+	key := testKey()
+
+	client, err := makeTestClient()
+	u.AssertNotError(err, "")
+
+	_, err = client.Put(key, "wrapped")
+	u.AssertNotError(err, "")
+
+	kv, _, err := client.KV().Get(key, nil)
+	u.AssertNotError(err, "")
+	u.AssertNotNil(kv, "")
+	u.AssertEquals("wrapped", string(kv.Value), "")
+}
+
+func TestLoadStructRelativePaths(t *testing.T) {
+	u := gounit.New(t)
+
+	prefix := testKey()
+
+	client, err := makeTestClient()
+	u.AssertNotError(err, "")
+
+	_, err = client.Put(prefix+"/nested/delay", "soon")
+	u.AssertNotError(err, "")
+
+	var s struct {
+		Nested Nested
+	}
+	err = client.LoadStructWithOptions(prefix, &s, consul.LoadOptions{RelativePaths: true})
+
+	var parseErr consul.ErrFieldParse
+	u.AssertEquals(true, errors.As(err, &parseErr), "errors.As ErrFieldParse")
+	u.AssertEquals("Nested/Delay", parseErr.Path, "")
+
+	err = client.LoadStruct(prefix, &s)
+	u.AssertEquals(true, errors.As(err, &parseErr), "errors.As ErrFieldParse")
+	u.AssertEquals(prefix+"/nested/delay", parseErr.Path, "full path by default")
+}
+
+func TestLoadStructs(t *testing.T) {
+	u := gounit.New(t)
+
+	prefix := testKey()
+
+	client, err := makeTestClient()
+	u.AssertNotError(err, "")
+
+	_, err = client.PutMulti(map[string]string{
+		prefix + "/db/host":    "db.local",
+		prefix + "/cache/size": "64",
+	})
+	u.AssertNotError(err, "")
+
+	var db struct {
+		Host string
+	}
+	var cache struct {
+		Size int
+	}
+	err = client.LoadStructs(map[string]interface{}{
+		prefix + "/db":    &db,
+		prefix + "/cache": &cache,
+	})
+	u.AssertNotError(err, "")
+	u.AssertEquals("db.local", db.Host, "")
+	u.AssertEquals(64, cache.Size, "")
+
+	var broken struct {
+		Size int
+	}
+	err = client.LoadStructs(map[string]interface{}{
+		prefix + "/db": &broken,
+	})
+	u.AssertEquals(true, err != nil && strings.Contains(err.Error(), prefix+"/db"), "error carries the prefix")
+}
+
+func TestLoadStructTextUnmarshaler(t *testing.T) {
+	u := gounit.New(t)
+
+	id := "6ba7b810-9dad-11d1-80b4-00c04fd430c8"
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Consul-Index", "10")
+		if r.URL.Path == "/v1/kv/service/id" {
+			w.Write(stubKVPair("service/id", id, 10))
+			return
+		}
+		http.NotFound(w, r)
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	var s struct {
+		ID    uuid.UUID
+		Owner uuid.UUID
+	}
+	err = client.LoadStruct("service", &s)
+	u.AssertNotError(err, "")
+	u.AssertEquals(uuid.MustParse(id), s.ID, "")
+	u.AssertEquals(uuid.UUID{}, s.Owner, "missing key keeps the zero value")
+}
+
+func TestGetStrAuto(t *testing.T) {
+	u := gounit.New(t)
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write([]byte("large config"))
+	u.AssertNotError(err, "")
+	u.AssertNotError(zw.Close(), "")
+
+	pairs := map[string]*consulapi.KVPair{
+		"/v1/kv/config/flagged": {Key: "config/flagged", Value: buf.Bytes(), Flags: consul.FlagGzip},
+		"/v1/kv/config/sniffed": {Key: "config/sniffed", Value: buf.Bytes()},
+		"/v1/kv/config/plain":   {Key: "config/plain", Value: []byte("plain config")},
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, ok := pairs[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode([]*consulapi.KVPair{p})
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	v, err := client.GetStrAuto("config/flagged")
+	u.AssertNotError(err, "")
+	u.AssertEquals("large config", v, "")
+
+	v, err = client.GetStrAuto("config/sniffed")
+	u.AssertNotError(err, "")
+	u.AssertEquals("large config", v, "")
+
+	v, err = client.GetStrAuto("config/plain")
+	u.AssertNotError(err, "")
+	u.AssertEquals("plain config", v, "")
+}
+
+func TestWatchGetStoppable(t *testing.T) {
+	u := gounit.New(t)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("index") {
+			// block until the watch is stopped
+			<-r.Context().Done()
+			return
+		}
+		w.Header().Set("X-Consul-Index", "10")
+		w.Write(stubKVPair("service/name", "api", 10))
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	ch, stop := client.WatchGetStoppable("service/name")
+
+	select {
+	case kv := <-ch:
+		u.AssertEquals("api", string(kv.Value), "")
+	case <-time.After(5 * time.Second):
+		t.Fatal("no value delivered")
+	}
+
+	stop()
+
+	select {
+	case _, ok := <-ch:
+		u.AssertEquals(false, ok, "channel closed")
+	case <-time.After(5 * time.Second):
+		t.Fatal("channel not closed after stop")
+	}
+}
+
+func TestLoadStructProfile(t *testing.T) {
+	u := gounit.New(t)
+
+	values := map[string]string{
+		"app/default/host":  "localhost",
+		"app/default/port":  "8080",
+		"app/default/debug": "true",
+		"app/prod/host":     "db.prod",
+		"app/prod/debug":    "false",
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		v, ok := values[key]
+		w.Header().Set("X-Consul-Index", "10")
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(stubKVPair(key, v, 10))
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	type config struct {
+		Host    string
+		Port    int
+		Debug   bool
+		Timeout int `consul:"default:30"`
+	}
+
+	var prod config
+	err = client.LoadStructProfile("app", "prod", &prod)
+	u.AssertNotError(err, "")
+	u.AssertEquals(config{Host: "db.prod", Port: 8080, Debug: false, Timeout: 30}, prod, "")
+
+	var staging config
+	err = client.LoadStructProfile("app", "staging", &staging)
+	u.AssertNotError(err, "missing profile")
+	u.AssertEquals(config{Host: "localhost", Port: 8080, Debug: true, Timeout: 30}, staging, "")
+}
+
+func TestNewClientVerified(t *testing.T) {
+	u := gounit.New(t)
+
+	config := consulapi.DefaultConfig()
+	config.Address = "127.0.0.1:1"
+
+	client, err := consul.NewClientVerified(config)
+	u.AssertEquals(true, err != nil, "unreachable agent")
+	u.AssertEquals(nil, client, "")
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`"10.0.0.1:8300"`))
+	})
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	config.Address = srv.URL
+	client, err = consul.NewClientVerified(config)
+	u.AssertNotError(err, "")
+	u.AssertNotNil(client, "")
+}
+
+func TestGetStrChain(t *testing.T) {
+	u := gounit.New(t)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/kv/timeout" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(stubKVPair("timeout", "30s", 10))
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	v, err := client.GetStrChain("timeout", "tenant/42", "tenant/default", "")
+	u.AssertNotError(err, "")
+	u.AssertEquals("30s", v, "")
+
+	_, err = client.GetStrChain("retries", "tenant/42", "tenant/default", "")
+	u.AssertEquals(consul.ErrKVNotFound{Key: "retries"}, err, "")
+}
+
+func TestErrNoClusterLeader(t *testing.T) {
+	u := gounit.New(t)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "No cluster leader", http.StatusInternalServerError)
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	_, _, err = client.Get("service/name")
+	u.AssertEquals(true, errors.Is(err, consul.ErrNoClusterLeader), "kv read")
+
+	var statusErr consulapi.StatusError
+	u.AssertEquals(true, errors.As(err, &statusErr), "original error wrapped")
+	u.AssertEquals(http.StatusInternalServerError, statusErr.Code, "")
+
+	_, _, err = client.GetServices("web", "")
+	u.AssertEquals(true, errors.Is(err, consul.ErrNoClusterLeader), "discovery read")
+}
+
+type endpoint struct {
+	Host string
+	Port int
+	Addr string
+}
+
+func (e *endpoint) AfterLoad() error {
+	if e.Port == 0 {
+		return errors.New("port required")
+	}
+	e.Addr = e.Host + ":" + strconv.Itoa(e.Port)
+	return nil
+}
+
+type upstreams struct {
+	Primary endpoint
+	Summary string
+}
+
+func (u *upstreams) AfterLoad() error {
+	// runs after the nested endpoint hook
+	u.Summary = "primary=" + u.Primary.Addr
+	return nil
+}
+
+func TestLoadStructAfterLoad(t *testing.T) {
+	u := gounit.New(t)
+
+	values := map[string]string{
+		"app/primary/host": "db.local",
+		"app/primary/port": "5432",
+		"bad/primary/host": "db.local",
+		"bad/primary/port": "0",
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		v, ok := values[key]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(stubKVPair(key, v, 10))
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	var s upstreams
+	err = client.LoadStruct("app", &s)
+	u.AssertNotError(err, "")
+	u.AssertEquals("db.local:5432", s.Primary.Addr, "")
+	u.AssertEquals("primary=db.local:5432", s.Summary, "")
+
+	err = client.LoadStruct("bad", &s)
+	u.AssertEquals(true, err != nil && strings.Contains(err.Error(), "port required"), "hook error aborts the load")
+}
+
+func TestUpdateConcurrent(t *testing.T) {
+	u := gounit.New(t)
+
+	key := testKey()
+
+	client, err := makeTestClient()
+	u.AssertNotError(err, "")
+
+	increment := func(old string) (string, error) {
+		n := 0
+		if old != "" {
+			var err error
+			if n, err = strconv.Atoi(old); err != nil {
+				return "", err
+			}
+		}
+		return strconv.Itoa(n + 1), nil
+	}
+
+	const workers, updates = 4, 5
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*updates)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < updates; j++ {
+				if _, err := client.Update(key, increment); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		u.AssertNotError(err, "")
+	}
+
+	v, err := client.GetStr(key)
+	u.AssertNotError(err, "")
+	u.AssertEquals(strconv.Itoa(workers*updates), v, "no lost updates")
+
+	_, err = client.Update(key, func(old string) (string, error) {
+		return "", errors.New("invalid")
+	})
+	u.AssertEquals("invalid", err.Error(), "fn error aborts")
+}
+
+func TestCachedLoadStruct(t *testing.T) {
+	u := gounit.New(t)
+
+	var mu sync.Mutex
+	var reads int
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		reads++
+		mu.Unlock()
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		w.Write(stubKVPair(key, "db.local", 10))
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	type config struct {
+		Host string
+	}
+
+	const ttl = 200 * time.Millisecond
+
+	var first config
+	err = client.CachedLoadStruct("app", &first, ttl)
+	u.AssertNotError(err, "")
+	u.AssertEquals("db.local", first.Host, "")
+	first.Host = "mutated"
+
+	var second config
+	err = client.CachedLoadStruct("app", &second, ttl)
+	u.AssertNotError(err, "")
+	u.AssertEquals("db.local", second.Host, "cached copy not shared")
+
+	mu.Lock()
+	u.AssertEquals(1, reads, "no backend reads within the ttl")
+	mu.Unlock()
+
+	time.Sleep(ttl)
+	err = client.CachedLoadStruct("app", &second, ttl)
+	u.AssertNotError(err, "")
+
+	mu.Lock()
+	u.AssertEquals(2, reads, "refreshed on expiry")
+	mu.Unlock()
+}
+
+func TestCachedLoadStructDeepCopy(t *testing.T) {
+	u := gounit.New(t)
+
+	values := map[string]string{
+		"app/ip":     "10.0.0.1",
+		"app/subnet": "10.0.0.0/24",
+		"app/limit":  "1000",
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		w.Write(stubKVPair(key, values[key], 10))
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	type config struct {
+		IP     net.IP
+		Subnet *net.IPNet
+		Limit  big.Int
+	}
+
+	var first config
+	u.AssertNotError(client.CachedLoadStruct("app", &first, time.Minute), "")
+	first.IP[3] = 99
+	first.Subnet.IP[2] = 99
+	// reuses the words of the int
+	first.Limit.SetInt64(5)
+
+	var second config
+	u.AssertNotError(client.CachedLoadStruct("app", &second, time.Minute), "")
+	u.AssertEquals("10.0.0.1", second.IP.String(), "slice not shared")
+	u.AssertEquals("10.0.0.0/24", second.Subnet.String(), "pointer not shared")
+	u.AssertEquals("1000", second.Limit.String(), "unexported slice not shared")
+
+	second.IP[3] = 42
+	var third config
+	u.AssertNotError(client.CachedLoadStruct("app", &third, time.Minute), "")
+	u.AssertEquals("10.0.0.1", third.IP.String(), "hits not shared")
+}
+
+func TestLoadStructReport(t *testing.T) {
+	u := gounit.New(t)
+
+	values := map[string]string{
+		"app/host":        "db.local",
+		"app/nested/name": "primary",
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		v, ok := values[key]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(stubKVPair(key, v, 10))
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	var s struct {
+		Host   string
+		Port   int `consul:"default:5432"`
+		User   string
+		Nested struct {
+			Name string
+		}
+	}
+	report, err := client.LoadStructReport("app", &s)
+	u.AssertNotError(err, "")
+	u.AssertEquals([]string{"Host", "Nested/Name"}, report.FromKV, "")
+	u.AssertEquals([]string{"Port"}, report.FromDefault, "")
+	u.AssertEquals([]string{"User"}, report.Zero, "")
+}
+
+func TestLoadStructArray(t *testing.T) {
+	u := gounit.New(t)
+
+	values := map[string]string{
+		"app/ports":  "1, 2,3",
+		"bad/ports":  "1,2",
+		"app/weight": "0.5,0.5",
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		v, ok := values[key]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(stubKVPair(key, v, 10))
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	var s struct {
+		Ports  [3]int
+		Weight [2]Weight `consul:"default:1,1"`
+	}
+	err = client.LoadStruct("app", &s)
+	u.AssertNotError(err, "")
+	u.AssertEquals([3]int{1, 2, 3}, s.Ports, "")
+	u.AssertEquals([2]Weight{0.5, 0.5}, s.Weight, "")
+
+	var bad struct {
+		Ports  [3]int
+		Weight [2]Weight `consul:"default:1,1"`
+	}
+	err = client.LoadStruct("bad", &bad)
+	var parseErr consul.ErrFieldParse
+	u.AssertEquals(true, errors.As(err, &parseErr), "length mismatch")
+	u.AssertEquals("bad/ports", parseErr.Path, "")
+}
+
+func TestLoadStructTimeLayout(t *testing.T) {
+	u := gounit.New(t)
+
+	values := map[string]string{
+		"app/released": "2024-03-15",
+		"app/updated":  "2024-03-15T10:30:00Z",
+		"app/opens":    "09:30",
+		"bad/released": "15/03/2024",
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		v, ok := values[key]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(stubKVPair(key, v, 10))
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	type schedule struct {
+		Released time.Time `consul:"layout:2006-01-02"`
+		Updated  time.Time
+		Opens    time.Time `consul:"layout:15:04"`
+		Closes   time.Time `consul:"default:18.00:layout:15.04"`
+	}
+
+	var s schedule
+	err = client.LoadStruct("app", &s)
+	u.AssertNotError(err, "")
+	u.AssertEquals(time.Date(2024, 3, 15, 0, 0, 0, 0, time.UTC), s.Released, "")
+	u.AssertEquals(time.Date(2024, 3, 15, 10, 30, 0, 0, time.UTC), s.Updated, "")
+	u.AssertEquals(time.Date(0, 1, 1, 9, 30, 0, 0, time.UTC), s.Opens, "")
+	u.AssertEquals(time.Date(0, 1, 1, 18, 0, 0, 0, time.UTC), s.Closes, "")
+
+	var bad schedule
+	err = client.LoadStruct("bad", &bad)
+	var parseErr consul.ErrFieldParse
+	u.AssertEquals(true, errors.As(err, &parseErr), "unparseable value")
+	u.AssertEquals("bad/released", parseErr.Path, "")
+
+	var invalid struct {
+		Released time.Time `consul:"layout:date"`
+	}
+	err = client.LoadStruct("app", &invalid)
+	u.AssertEquals(true, errors.As(err, &parseErr), "invalid layout")
+	u.AssertEquals("app/released", parseErr.Path, "")
+}
+
+// stubKVStore serves recursive lists and transactions of set operations
+// from an in-memory KV tree, counting the transactions
+func stubKVStore(kv map[string]string, txns *int) http.Handler {
+	var mu sync.Mutex
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if r.URL.Path == "/v1/txn" {
+			var ops consulapi.TxnOps
+			if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			for _, op := range ops {
+				kv[op.KV.Key] = string(op.KV.Value)
+			}
+			*txns++
+			json.NewEncoder(w).Encode(&consulapi.TxnResponse{})
+			return
+		}
+
+		prefix := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		var pairs consulapi.KVPairs
+		for k, v := range kv {
+			if strings.HasPrefix(k, prefix) {
+				pairs = append(pairs, &consulapi.KVPair{Key: k, Value: []byte(v)})
+			}
+		}
+		w.Header().Set("X-Consul-Index", "10")
+		json.NewEncoder(w).Encode(pairs)
+	})
+}
+
+func TestReconcileStruct(t *testing.T) {
+	u := gounit.New(t)
+
+	kv := map[string]string{
+		"app/host":        "db.local",
+		"app/port":        "6543",
+		"app/nested/name": "primary",
+	}
+	var txns int
+	client, srv, err := testutil.NewStubClient(stubKVStore(kv, &txns))
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	desired := struct {
+		Host   string
+		Port   int
+		Nested struct {
+			Name string
+		}
+	}{Host: "db.local", Port: 5432}
+	desired.Nested.Name = "primary"
+
+	changed, err := client.ReconcileStruct("app", desired)
+	u.AssertNotError(err, "")
+	u.AssertEquals([]string{"app/port"}, changed, "")
+	u.AssertEquals("5432", kv["app/port"], "drift corrected")
+	u.AssertEquals(1, txns, "")
+
+	changed, err = client.ReconcileStruct("app", desired)
+	u.AssertNotError(err, "")
+	u.AssertEquals(0, len(changed), "in sync")
+	u.AssertEquals(1, txns, "nothing written when in sync")
+}
+
+func TestStat(t *testing.T) {
+	u := gounit.New(t)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/kv/service/leader" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode([]*consulapi.KVPair{{
+			Key:         "service/leader",
+			Value:       []byte("node-1"),
+			CreateIndex: 7,
+			ModifyIndex: 12,
+			LockIndex:   2,
+			Flags:       42,
+			Session:     "adf4238a-882b-9ddc-4a9d-5b6758e4159e",
+		}})
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	stat, err := client.Stat("service/leader")
+	u.AssertNotError(err, "")
+	u.AssertEquals(consul.KVStat{
+		CreateIndex: 7,
+		ModifyIndex: 12,
+		LockIndex:   2,
+		Flags:       42,
+		Session:     "adf4238a-882b-9ddc-4a9d-5b6758e4159e",
+	}, *stat, "")
+
+	_, err = client.Stat("service/missing")
+	u.AssertEquals(consul.ErrKVNotFound{Key: "service/missing"}, err, "")
+}
+
+func TestLoadStructNet(t *testing.T) {
+	u := gounit.New(t)
+
+	values := map[string]string{
+		"app/ip":     "10.0.0.1",
+		"app/subnet": "10.0.0.7/24",
+		"bad/ip":     "10.0.0.1",
+		"bad/subnet": "10.0.0.0/33",
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		v, ok := values[key]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(stubKVPair(key, v, 10))
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	type config struct {
+		IP      net.IP
+		Subnet  *net.IPNet
+		Allowed net.IPNet `consul:"default:192.168.0.0/16"`
+	}
+
+	var s config
+	err = client.LoadStruct("app", &s)
+	u.AssertNotError(err, "")
+	u.AssertEquals("10.0.0.1", s.IP.String(), "")
+	u.AssertEquals("10.0.0.0/24", s.Subnet.String(), "")
+	u.AssertEquals("192.168.0.0/16", s.Allowed.String(), "")
+
+	var bad config
+	err = client.LoadStruct("bad", &bad)
+	var parseErr consul.ErrFieldParse
+	u.AssertEquals(true, errors.As(err, &parseErr), "invalid CIDR")
+	u.AssertEquals("bad/subnet", parseErr.Path, "")
+}
+
+// reverseCipher reverses the bytes behind a prefix, for tests only
+type reverseCipher struct{}
+
+func (reverseCipher) Encrypt(plaintext []byte) ([]byte, error) {
+	out := []byte("enc:")
+	for i := len(plaintext) - 1; i >= 0; i-- {
+		out = append(out, plaintext[i])
+	}
+	return out, nil
+}
+
+func (c reverseCipher) Decrypt(ciphertext []byte) ([]byte, error) {
+	if !bytes.HasPrefix(ciphertext, []byte("enc:")) {
+		return nil, errors.New("not encrypted")
+	}
+	out, _ := c.Encrypt(ciphertext[len("enc:"):])
+	return out[len("enc:"):], nil
+}
+
+func TestStructEncryptedField(t *testing.T) {
+	u := gounit.New(t)
+
+	type config struct {
+		User     string
+		Password string `consul:"encrypted:true"`
+	}
+
+	kv := map[string]string{}
+	var txns int
+	client, srv, err := testutil.NewStubClient(stubKVStore(kv, &txns), consul.WithCipher(reverseCipher{}))
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	_, err = client.ReconcileStruct("db", config{User: "admin", Password: "s3cret"})
+	u.AssertNotError(err, "")
+	u.AssertEquals("admin", kv["db/user"], "")
+	u.AssertEquals("enc:terc3s", kv["db/password"], "stored encrypted")
+
+	var loaded config
+	err = client.LoadStruct("db", &loaded)
+	u.AssertNotError(err, "")
+	u.AssertEquals(config{User: "admin", Password: "s3cret"}, loaded, "round-trip")
+
+	changed, err := client.ReconcileStruct("db", loaded)
+	u.AssertNotError(err, "")
+	u.AssertEquals(0, len(changed), "compared decrypted")
+
+	plain, srv2, err := testutil.NewStubClient(stubKVStore(kv, &txns))
+	u.AssertNotError(err, "")
+	defer srv2.Close()
+
+	err = plain.LoadStruct("db", &loaded)
+	u.AssertEquals(true, errors.Is(err, consul.ErrNoCipher), "no cipher")
+}
+
+func TestLoadStructStrictTags(t *testing.T) {
+	u := gounit.New(t)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+
+	var s struct {
+		Host string `consul:"defualt:localhost"`
+	}
+
+	lenient, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	err = lenient.LoadStruct("app", &s)
+	u.AssertNotError(err, "unknown option ignored by default")
+
+	strict, srv2, err := testutil.NewStubClient(handler, consul.WithStrictTags())
+	u.AssertNotError(err, "")
+	defer srv2.Close()
+
+	err = strict.LoadStruct("app", &s)
+	u.AssertEquals(true, errors.Is(err, consul.ErrInvalidTagOptions), "misspelled option")
+}
+
+func TestGetIntBOM(t *testing.T) {
+	u := gounit.New(t)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Consul-Index", "10")
+		w.Write(stubKVPair(strings.TrimPrefix(r.URL.Path, "/v1/kv/"), "\ufeff42", 10))
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	n, err := client.GetInt("app/workers")
+	u.AssertNotError(err, "")
+	u.AssertEquals(42, n, "")
+
+	var s struct {
+		Workers int
+	}
+	err = client.LoadStruct("app", &s)
+	u.AssertNotError(err, "")
+	u.AssertEquals(42, s.Workers, "")
+
+	kv, _, err := client.Get("app/workers")
+	u.AssertNotError(err, "")
+	u.AssertEquals("\ufeff42", string(kv.Value), "raw value untouched")
+}
+
+func TestGetBytesSize(t *testing.T) {
+	u := gounit.New(t)
+
+	values := map[string]string{
+		"app/buffer":        "512KB",
+		"app/cache":         "2GiB",
+		"app/bad":           "12XB",
+		"limits/max_body":   "1.5MiB",
+		"limits/max_header": "8KiB",
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		v, ok := values[key]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(stubKVPair(key, v, 10))
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	n, err := client.GetBytesSize("app/buffer")
+	u.AssertNotError(err, "")
+	u.AssertEquals(int64(512000), n, "decimal")
+
+	n, err = client.GetBytesSize("app/cache")
+	u.AssertNotError(err, "")
+	u.AssertEquals(int64(2<<30), n, "binary")
+
+	_, err = client.GetBytesSize("app/bad")
+	u.AssertEquals(true, err != nil && strings.Contains(err.Error(), "unknown unit"), "malformed")
+
+	var limits struct {
+		MaxBody   int64 `consul:"name:max_body:size:true"`
+		MaxHeader int32 `consul:"name:max_header:size:true"`
+		MaxConns  int   `consul:"name:max_conns:default:1KB:size:true"`
+	}
+	err = client.LoadStruct("limits", &limits)
+	u.AssertNotError(err, "")
+	u.AssertEquals(int64(1572864), limits.MaxBody, "")
+	u.AssertEquals(int32(8192), limits.MaxHeader, "")
+	u.AssertEquals(1000, limits.MaxConns, "")
+}
+
+func TestSwapValues(t *testing.T) {
+	u := gounit.New(t)
+
+	active, standby := testKey(), testKey()
+
+	client, err := makeTestClient()
+	u.AssertNotError(err, "")
+	defer client.Delete(active)
+	defer client.Delete(standby)
+
+	_, err = client.Put(active, "blue")
+	u.AssertNotError(err, "")
+
+	err = client.SwapValues(active, standby)
+	var notFound consul.ErrKVNotFound
+	u.AssertEquals(true, errors.As(err, &notFound), "missing key")
+
+	_, err = client.Put(standby, "green")
+	u.AssertNotError(err, "")
+
+	u.AssertNotError(client.SwapValues(active, standby), "")
+	v, err := client.GetStr(active)
+	u.AssertNotError(err, "")
+	u.AssertEquals("green", v, "")
+	v, err = client.GetStr(standby)
+	u.AssertNotError(err, "")
+	u.AssertEquals("blue", v, "")
+
+	// an even number of concurrent swaps restores the values, a non-atomic
+	// swap would leave both keys with the same value
+	const workers = 4
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := client.SwapValues(active, standby); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		u.AssertNotError(err, "")
+	}
+
+	v, err = client.GetStr(active)
+	u.AssertNotError(err, "")
+	u.AssertEquals("green", v, "")
+	v, err = client.GetStr(standby)
+	u.AssertNotError(err, "")
+	u.AssertEquals("blue", v, "")
+}
+
+func TestLoadStructWithFailover(t *testing.T) {
+	u := gounit.New(t)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dc := r.URL.Query().Get("dc")
+		if dc == "dc1" {
+			http.Error(w, "No path to datacenter", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("X-Consul-Index", "10")
+		if r.URL.Query().Has("keys") {
+			json.NewEncoder(w).Encode([]string{"app/host"})
+			return
+		}
+		if r.URL.Path == "/v1/kv/app/host" {
+			w.Write(stubKVPair("app/host", "db."+dc, 10))
+			return
+		}
+		http.NotFound(w, r)
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	var s struct {
+		Host string
+	}
+	err = client.LoadStructWithFailover("app", []string{"dc1", "dc2"}, &s)
+	u.AssertNotError(err, "")
+	u.AssertEquals("db.dc2", s.Host, "failed over to dc2")
+
+	err = client.LoadStructWithFailover("app", []string{"dc1"}, &s)
+	var notFound consul.ErrKVNotFound
+	u.AssertEquals(true, errors.As(err, &notFound), "every datacenter unreachable")
+}
+
+func TestContextCancellation(t *testing.T) {
+	u := gounit.New(t)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/kv/app/name" && !r.URL.Query().Has("index") {
+			w.Header().Set("X-Consul-Index", "10")
+			w.Write(stubKVPair("app/name", "api", 10))
+			return
+		}
+		// a hung agent or blocking query
+		<-r.Context().Done()
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, _, err = client.GetContext(ctx, "app/slow")
+	u.AssertEquals(true, errors.Is(err, context.DeadlineExceeded), "get")
+
+	_, _, err = client.GetServicesContext(ctx, "api", "")
+	u.AssertEquals(true, errors.Is(err, context.DeadlineExceeded), "services")
+
+	var s struct {
+		Slow string
+	}
+	err = client.LoadStructContext(ctx, "app", &s)
+	u.AssertEquals(true, errors.Is(err, context.DeadlineExceeded), "load struct")
+
+	wctx, wcancel := context.WithCancel(context.Background())
+	ch := client.WatchGetContext(wctx, "app/name")
+	select {
+	case kv := <-ch:
+		u.AssertEquals("api", string(kv.Value), "")
+	case <-time.After(5 * time.Second):
+		t.Fatal("no value delivered")
+	}
+	wcancel()
+	select {
+	case _, ok := <-ch:
+		u.AssertEquals(false, ok, "closed on cancel")
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch not cancelled")
+	}
+}
+
+func TestSaveStruct(t *testing.T) {
+	u := gounit.New(t)
+
+	kv := map[string]string{}
+	var txns int
+	client, srv, err := testutil.NewStubClient(stubKVStore(kv, &txns))
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	type config struct {
+		Host    string `consul:"name:db_host"`
+		Port    int
+		Enabled bool
+		Weights [2]float64
+		Since   time.Time `consul:"layout:2006-01-02"`
+		ID      uuid.UUID
+		Nested  struct {
+			Level uint8
+		}
+	}
+	saved := config{
+		Host:    "db.local",
+		Port:    5432,
+		Enabled: true,
+		Weights: [2]float64{0.25, 0.75},
+		Since:   time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC),
+		ID:      uuid.MustParse("6ba7b810-9dad-11d1-80b4-00c04fd430c8"),
+	}
+	saved.Nested.Level = 3
+
+	err = client.SaveStruct("app", &saved)
+	u.AssertNotError(err, "")
+	u.AssertEquals("db.local", kv["app/db_host"], "")
+	u.AssertEquals("0.25,0.75", kv["app/weights"], "")
+	u.AssertEquals("2024-03-01", kv["app/since"], "")
+	u.AssertEquals("3", kv["app/nested/level"], "")
+
+	var loaded config
+	err = client.LoadStruct("app", &loaded)
+	u.AssertNotError(err, "")
+	u.AssertEquals(saved, loaded, "round-trip")
+}
+
+func TestLoadStructIntsAndDurations(t *testing.T) {
+	u := gounit.New(t)
+
+	values := map[string]string{
+		"app/retries": "5",
+		"app/offset":  "-300",
+		"app/limit":   "70000",
+		"app/total":   "9000000000",
+		"app/timeout": "1m30s",
+		"app/workers": "8",
+		"app/enabled": "true",
+		"app/since":   "2024-03-01T10:00:00Z",
+		"bad/retries": "300",
+		"bad/timeout": "90",
+		"bad/offset":  "1",
+		"bad/limit":   "1",
+		"bad/total":   "1",
+		"bad/workers": "1",
+		"bad/enabled": "true",
+		"bad/since":   "2024-03-01T10:00:00Z",
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		v, ok := values[key]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(stubKVPair(key, v, 10))
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	type config struct {
+		Retries int8
+		Offset  int16
+		Limit   int32
+		Total   int64
+		Timeout time.Duration
+		Backoff time.Duration `consul:"default:250ms"`
+		Workers uint
+		Enabled bool
+		Since   time.Time
+	}
+
+	var s config
+	err = client.LoadStruct("app", &s)
+	u.AssertNotError(err, "")
+	u.AssertEquals(config{
+		Retries: 5,
+		Offset:  -300,
+		Limit:   70000,
+		Total:   9000000000,
+		Timeout: 90 * time.Second,
+		Backoff: 250 * time.Millisecond,
+		Workers: 8,
+		Enabled: true,
+		Since:   time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC),
+	}, s, "")
+
+	var bad config
+	err = client.LoadStruct("bad", &bad)
+	var parseErr consul.ErrFieldParse
+	u.AssertEquals(true, errors.As(err, &parseErr), "int8 overflow")
+	u.AssertEquals("bad/retries", parseErr.Path, "")
+
+	values["bad/retries"] = "1"
+	err = client.LoadStruct("bad", &bad)
+	u.AssertEquals(true, errors.As(err, &parseErr), "duration without unit")
+	u.AssertEquals("bad/timeout", parseErr.Path, "")
+}
+
+func TestContextVariantsCancellation(t *testing.T) {
+	u := gounit.New(t)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/kv/app/name" && !r.URL.Query().Has("index") {
+			w.Header().Set("X-Consul-Index", "10")
+			w.Write(stubKVPair("app/name", "api", 10))
+			return
+		}
+		// a hung agent or blocking query
+		<-r.Context().Done()
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	calls := map[string]func() error{
+		"GetStr": func() error {
+			_, err := client.GetStrContext(ctx, "app/slow")
+			return err
+		},
+		"GetEventual": func() error {
+			_, _, err := client.GetEventualContext(ctx, "app/slow", 3, time.Second)
+			return err
+		},
+		"GetFirstService": func() error {
+			_, _, err := client.GetFirstServiceContext(ctx, "api", "")
+			return err
+		},
+		"RegisterService": func() error {
+			return client.RegisterServiceContext(ctx, "api", "127.0.0.1:8080")
+		},
+		"DeRegisterService": func() error {
+			return client.DeRegisterServiceContext(ctx, "api")
+		},
+		"PutMulti": func() error {
+			_, err := client.PutMultiContext(ctx, map[string]string{"app/a": "1"})
+			return err
+		},
+		"Update": func() error {
+			_, err := client.UpdateContext(ctx, "app/counter", func(old string) (string, error) {
+				return old + "1", nil
+			})
+			return err
+		},
+		"ListSince": func() error {
+			_, _, err := client.ListSinceContext(ctx, "app", 0)
+			return err
+		},
+		"SaveStruct": func() error {
+			return client.SaveStructContext(ctx, "app", &struct{ Name string }{Name: "api"})
+		},
+		"TokenSelf": func() error {
+			_, err := client.TokenSelfContext(ctx)
+			return err
+		},
+	}
+	for name, call := range calls {
+		err := call()
+		u.AssertEquals(true, errors.Is(err, context.DeadlineExceeded), name)
+	}
+
+	wctx, wcancel := context.WithCancel(context.Background())
+	events := client.WatchGetEventsContext(wctx, "app/name")
+	tree := client.WatchTreeContext(wctx, "app/slow")
+	select {
+	case e := <-events:
+		u.AssertEquals("api", string(e.KV.Value), "")
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event delivered")
+	}
+	wcancel()
+	for name, closed := range map[string]func() bool{
+		"events": func() bool { _, ok := <-events; return !ok },
+		"tree":   func() bool { _, ok := <-tree; return !ok },
+	} {
+		done := make(chan bool, 1)
+		go func() { done <- closed() }()
+		select {
+		case ok := <-done:
+			u.AssertEquals(true, ok, name+" closed on cancel")
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s watch not cancelled", name)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/l-vitaly/consul"
+	"github.com/l-vitaly/consul/testutil"
+	"github.com/l-vitaly/gounit"
+)
+
+func TestConfigStoreSubscribers(t *testing.T) {
+	u := gounit.New(t)
+
+	prefix := testKey()
+
+	client, err := makeTestClient()
+	u.AssertNotError(err, "")
+
+	_, err = client.Put(prefix+"/a", "1")
+	u.AssertNotError(err, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store, err := consul.NewConfigStore(ctx, client, prefix)
+	u.AssertNotError(err, "")
+
+	first, firstUpdates := store.Subscribe()
+	second, secondUpdates := store.Subscribe()
+	u.AssertEquals(1, len(first.Pairs), "")
+	u.AssertEquals(first.Version, second.Version, "")
+
+	_, err = client.Put(prefix+"/b", "2")
+	u.AssertNotError(err, "")
+
+	for _, updates := range []<-chan consul.Snapshot{firstUpdates, secondUpdates} {
+		select {
+		case snap := <-updates:
+			u.AssertEquals(2, len(snap.Pairs), "")
+			u.AssertEquals(true, snap.Version > first.Version, "version incremented")
+		case <-time.After(5 * time.Second):
+			t.Fatal("subscriber did not see the update")
+		}
+	}
+
+	store.Unsubscribe(firstUpdates)
+	_, ok := <-firstUpdates
+	u.AssertEquals(false, ok, "closed on unsubscribe")
+}
+
+func TestConfigStoreClosedOnCancel(t *testing.T) {
+	u := gounit.New(t)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("index") != "" {
+			<-r.Context().Done()
+			return
+		}
+		w.Header().Set("X-Consul-Index", "10")
+		w.Write(stubKVPair("app/name", "v0", 10))
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store, err := consul.NewConfigStore(ctx, client, "app")
+	u.AssertNotError(err, "")
+	_, updates := store.Subscribe()
+
+	cancel()
+	select {
+	case _, ok := <-updates:
+		u.AssertEquals(false, ok, "closed when ctx is done")
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscriber channel not closed")
+	}
+
+	_, late := store.Subscribe()
+	_, ok := <-late
+	u.AssertEquals(false, ok, "closed after the watch stopped")
+}
+
+func TestConfigStoreNoLeader(t *testing.T) {
+	u := gounit.New(t)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "No cluster leader", http.StatusInternalServerError)
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	_, err = consul.NewConfigStore(context.Background(), client, "app")
+	u.AssertEquals(true, errors.Is(err, consul.ErrNoClusterLeader), "")
+}
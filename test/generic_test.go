@@ -0,0 +1,128 @@
+package test
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/l-vitaly/consul"
+	"github.com/l-vitaly/consul/testutil"
+	"github.com/l-vitaly/gounit"
+)
+
+func TestGetAs(t *testing.T) {
+	u := gounit.New(t)
+
+	prefix := testKey()
+
+	client, err := makeTestClient()
+	u.AssertNotError(err, "")
+
+	_, err = client.PutMulti(map[string]string{
+		prefix + "/int":    "42",
+		prefix + "/bool":   "true",
+		prefix + "/struct": `{"host":"db.local","port":5432}`,
+	})
+	u.AssertNotError(err, "")
+
+	n, err := consul.GetAs[int](client, prefix+"/int")
+	u.AssertNotError(err, "")
+	u.AssertEquals(42, n, "")
+
+	b, err := consul.GetAs[bool](client, prefix+"/bool")
+	u.AssertNotError(err, "")
+	u.AssertEquals(true, b, "")
+
+	type db struct {
+		Host string `json:"host"`
+		Port int    `json:"port"`
+	}
+	d, err := consul.GetAs[db](client, prefix+"/struct")
+	u.AssertNotError(err, "")
+	u.AssertEquals(db{Host: "db.local", Port: 5432}, d, "")
+}
+
+func TestWatchConfig(t *testing.T) {
+	u := gounit.New(t)
+
+	parent := testKey()
+
+	client, err := makeTestClient()
+	u.AssertNotError(err, "")
+
+	_, err = client.Put(parent+"/name", "before")
+	u.AssertNotError(err, "")
+
+	type config struct {
+		Name string
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p, _, err := consul.WatchConfig[config](ctx, client, parent)
+	u.AssertNotError(err, "")
+	u.AssertEquals("before", p.Load().Name, "initial config")
+
+	_, err = client.Put(parent+"/name", "after")
+	u.AssertNotError(err, "")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for p.Load().Name != "after" {
+		if time.Now().After(deadline) {
+			t.Fatal("readers did not see the new config")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWatchConfigNoInitialReload(t *testing.T) {
+	u := gounit.New(t)
+
+	var mu sync.Mutex
+	loads := 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("index") != "" {
+			<-r.Context().Done()
+			return
+		}
+		mu.Lock()
+		loads++
+		mu.Unlock()
+		w.Header().Set("X-Consul-Index", "10")
+		w.Write(stubKVPair("app/name", "v0", 10))
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	type config struct {
+		Name string
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p, errs, err := consul.WatchConfig[config](ctx, client, "app")
+	u.AssertNotError(err, "")
+	u.AssertEquals("v0", p.Load().Name, "")
+
+	mu.Lock()
+	initial := loads
+	mu.Unlock()
+	time.Sleep(300 * time.Millisecond)
+	mu.Lock()
+	u.AssertEquals(initial, loads, "the watch starts at the index of the initial load")
+	mu.Unlock()
+
+	cancel()
+	select {
+	case _, ok := <-errs:
+		u.AssertEquals(false, ok, "closed on cancel")
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch not stopped")
+	}
+}
@@ -0,0 +1,1046 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/l-vitaly/consul"
+	"github.com/l-vitaly/consul/testutil"
+	"github.com/l-vitaly/gounit"
+)
+
+// registerPassing registers a service with a passing TTL check directly
+// through the agent and returns a function deregistering it
+func registerPassing(t *testing.T, reg *consulapi.AgentServiceRegistration) func() {
+	raw, err := consulapi.NewClient(consulapi.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reg.Address == "" {
+		reg.Address = "127.0.0.1"
+	}
+	if reg.Port == 0 {
+		reg.Port = 8080
+	}
+	reg.Check = &consulapi.AgentServiceCheck{
+		TTL:    "30s",
+		Status: consulapi.HealthPassing,
+	}
+
+	if err := raw.Agent().ServiceRegister(reg); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		raw.Agent().ServiceDeregister(reg.ID)
+	}
+}
+
+func TestWaitForServicesOptsFilter(t *testing.T) {
+	u := gounit.New(t)
+
+	client, err := makeTestClient()
+	u.AssertNotError(err, "")
+
+	name := "wait-" + testKey()
+	for _, version := range []string{"stable", "canary"} {
+		deregister := registerPassing(t, &consulapi.AgentServiceRegistration{
+			ID:   name + "-" + version,
+			Name: name,
+			Meta: map[string]string{"version": version},
+		})
+		defer deregister()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	addrs, err := client.WaitForServicesOpts(ctx, name, consul.WaitOptions{
+		Filter: `Service.Meta.version == "canary"`,
+		Min:    1,
+	})
+	u.AssertNotError(err, "")
+	u.AssertEquals(1, len(addrs), "")
+	u.AssertEquals(name+"-canary", addrs[0].Service.ID, "")
+}
+
+func TestRegisterServiceInvalidAddr(t *testing.T) {
+	u := gounit.New(t)
+
+	client, err := makeTestClient()
+	u.AssertNotError(err, "")
+
+	err = client.RegisterService("invalid", "bad-host")
+	u.AssertEquals(true, errors.Is(err, consul.ErrInvalidServiceAddr), "errors.Is ErrInvalidServiceAddr")
+	u.AssertEquals(true, strings.Contains(err.Error(), "bad-host"), "message contains address")
+
+	err = client.RegisterService("invalid", "localhost:http-port")
+	u.AssertEquals(true, errors.Is(err, consul.ErrInvalidPort), "errors.Is ErrInvalidPort")
+	u.AssertEquals(true, strings.Contains(err.Error(), "http-port"), "message contains port")
+}
+
+func TestGetServicesAtIndex(t *testing.T) {
+	u := gounit.New(t)
+
+	client, err := makeTestClient()
+	u.AssertNotError(err, "")
+
+	api := "api-" + testKey()
+	db := "db-" + testKey()
+	defer registerPassing(t, &consulapi.AgentServiceRegistration{ID: api, Name: api})()
+	defer registerPassing(t, &consulapi.AgentServiceRegistration{ID: db, Name: db})()
+
+	res, index, err := client.GetServicesAtIndex([]string{api, db}, "")
+	u.AssertNotError(err, "")
+	u.AssertEquals(1, len(res[api]), api)
+	u.AssertEquals(1, len(res[db]), db)
+	u.AssertEquals(true, index > 0, "index")
+}
+
+// stubRegistrations returns a handler recording the service registrations
+// it receives
+func stubRegistrations(regs chan<- *consulapi.AgentServiceRegistration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/agent/service/register" {
+			http.NotFound(w, r)
+			return
+		}
+		var reg consulapi.AgentServiceRegistration
+		if err := json.NewDecoder(r.Body).Decode(&reg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		regs <- &reg
+	})
+}
+
+func TestRegisterServiceCheckThresholds(t *testing.T) {
+	u := gounit.New(t)
+
+	regs := make(chan *consulapi.AgentServiceRegistration, 1)
+	client, srv, err := testutil.NewStubClient(stubRegistrations(regs))
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	err = client.RegisterServiceWithOptions(consul.ServiceOptions{
+		Name:                   "flappy",
+		Address:                "127.0.0.1:8080",
+		Status:                 consulapi.HealthPassing,
+		SuccessBeforePassing:   3,
+		FailuresBeforeCritical: 2,
+	})
+	u.AssertNotError(err, "")
+
+	reg := <-regs
+	u.AssertEquals(3, reg.Check.SuccessBeforePassing, "")
+	u.AssertEquals(2, reg.Check.FailuresBeforeCritical, "")
+	u.AssertEquals(consulapi.HealthPassing, reg.Check.Status, "")
+
+	err = client.RegisterServiceWithOptions(consul.ServiceOptions{
+		Name:                 "flappy",
+		Address:              "127.0.0.1:8080",
+		SuccessBeforePassing: -1,
+	})
+	u.AssertEquals(true, errors.Is(err, consul.ErrInvalidCheckOptions), "")
+}
+
+func TestRegisterConnectService(t *testing.T) {
+	u := gounit.New(t)
+
+	client, err := makeTestClient()
+	u.AssertNotError(err, "")
+
+	raw, err := consulapi.NewClient(consulapi.DefaultConfig())
+	u.AssertNotError(err, "")
+
+	name := "web-" + testKey()
+	err = client.RegisterConnectService(name, "127.0.0.1:8080", []consul.Upstream{
+		{DestinationName: "db", LocalBindPort: 9191},
+	})
+	u.AssertNotError(err, "")
+	defer client.DeRegisterService(name)
+
+	services, err := raw.Agent().Services()
+	u.AssertNotError(err, "")
+
+	proxy, ok := services[name+"-sidecar-proxy"]
+	u.AssertEquals(true, ok, "sidecar proxy registered")
+	u.AssertEquals(consulapi.ServiceKindConnectProxy, proxy.Kind, "")
+	u.AssertEquals(name, proxy.Proxy.DestinationServiceName, "")
+	u.AssertEquals(1, len(proxy.Proxy.Upstreams), "")
+	u.AssertEquals("db", proxy.Proxy.Upstreams[0].DestinationName, "")
+}
+
+func TestDeRegisterAllOwn(t *testing.T) {
+	u := gounit.New(t)
+
+	client, err := makeTestClient()
+	u.AssertNotError(err, "")
+
+	raw, err := consulapi.NewClient(consulapi.DefaultConfig())
+	u.AssertNotError(err, "")
+
+	first := "own-" + testKey()
+	second := "own-" + testKey()
+	other := "other-" + testKey()
+
+	u.AssertNotError(client.RegisterService(first, "127.0.0.1:8080"), "")
+	u.AssertNotError(client.RegisterService(second, "127.0.0.1:8081"), "")
+	defer registerPassing(t, &consulapi.AgentServiceRegistration{ID: other, Name: other})()
+
+	err = client.DeRegisterAllOwn()
+	u.AssertNotError(err, "")
+
+	services, err := raw.Agent().Services()
+	u.AssertNotError(err, "")
+
+	_, ok := services[first]
+	u.AssertEquals(false, ok, first)
+	_, ok = services[second]
+	u.AssertEquals(false, ok, second)
+	_, ok = services[other]
+	u.AssertEquals(true, ok, other)
+}
+
+// stubServiceEntries returns a handler serving entries for any health query
+func stubServiceEntries(entries []*consulapi.ServiceEntry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Consul-Index", "10")
+		json.NewEncoder(w).Encode(entries)
+	})
+}
+
+func TestGetServiceTaggedAddress(t *testing.T) {
+	u := gounit.New(t)
+
+	entries := []*consulapi.ServiceEntry{
+		{
+			Node: &consulapi.Node{Node: "node-1", Address: "10.0.0.1"},
+			Service: &consulapi.AgentService{
+				ID:      "api-1",
+				Service: "api",
+				Address: "10.0.0.1",
+				Port:    8080,
+				TaggedAddresses: map[string]consulapi.ServiceAddress{
+					"wan": {Address: "203.0.113.1", Port: 443},
+				},
+			},
+		},
+		{
+			Node: &consulapi.Node{
+				Node:            "node-2",
+				Address:         "10.0.0.2",
+				TaggedAddresses: map[string]string{"wan": "203.0.113.2"},
+			},
+			Service: &consulapi.AgentService{ID: "api-2", Service: "api", Port: 8080},
+		},
+		{
+			Node:    &consulapi.Node{Node: "node-3", Address: "10.0.0.3"},
+			Service: &consulapi.AgentService{ID: "api-3", Service: "api", Port: 8080},
+		},
+	}
+
+	client, srv, err := testutil.NewStubClient(stubServiceEntries(entries))
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	addrs, err := client.GetServiceTaggedAddress("api", "", "wan")
+	u.AssertNotError(err, "")
+	u.AssertEquals([]string{"203.0.113.1:443", "203.0.113.2:8080", "10.0.0.3:8080"}, addrs, "")
+}
+
+func TestGetServiceAddressesMin(t *testing.T) {
+	u := gounit.New(t)
+
+	entries := []*consulapi.ServiceEntry{{
+		Node:    &consulapi.Node{Node: "node-1", Address: "10.0.0.1"},
+		Service: &consulapi.AgentService{ID: "api-1", Service: "api", Port: 8080},
+	}}
+
+	client, srv, err := testutil.NewStubClient(stubServiceEntries(entries))
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	addrs, err := client.GetServiceAddressesMin("api", "", 1)
+	u.AssertNotError(err, "")
+	u.AssertEquals([]string{"10.0.0.1:8080"}, addrs, "")
+
+	_, err = client.GetServiceAddressesMin("api", "", 2)
+	var insufficient consul.ErrInsufficientInstances
+	u.AssertEquals(true, errors.As(err, &insufficient), "errors.As ErrInsufficientInstances")
+	u.AssertEquals(1, insufficient.Count, "")
+	u.AssertEquals(2, insufficient.Min, "")
+}
+
+func TestRegisterServiceCheckInterval(t *testing.T) {
+	u := gounit.New(t)
+
+	regs := make(chan *consulapi.AgentServiceRegistration, 1)
+	client, srv, err := testutil.NewStubClient(stubRegistrations(regs))
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	err = client.RegisterServiceWithOptions(consul.ServiceOptions{
+		Name:     "web",
+		Address:  "127.0.0.1:8080",
+		HTTP:     "http://127.0.0.1:8080/health",
+		Interval: 5 * time.Second,
+		Timeout:  5 * time.Second,
+	})
+	u.AssertEquals(true, errors.Is(err, consul.ErrInvalidCheckOptions), "timeout equal to interval")
+
+	err = client.RegisterServiceWithOptions(consul.ServiceOptions{
+		Name:    "web",
+		Address: "127.0.0.1:8080",
+		TCP:     "127.0.0.1:8080",
+		Timeout: time.Second,
+	})
+	u.AssertEquals(true, errors.Is(err, consul.ErrInvalidCheckOptions), "missing interval")
+
+	err = client.RegisterServiceWithOptions(consul.ServiceOptions{
+		Name:     "web",
+		Address:  "127.0.0.1:8080",
+		HTTP:     "http://127.0.0.1:8080/health",
+		Interval: 10 * time.Second,
+		Timeout:  time.Second,
+	})
+	u.AssertNotError(err, "")
+
+	reg := <-regs
+	u.AssertEquals("http://127.0.0.1:8080/health", reg.Check.HTTP, "")
+	u.AssertEquals("10s", reg.Check.Interval, "")
+	u.AssertEquals("1s", reg.Check.Timeout, "")
+	u.AssertEquals("", reg.Check.TTL, "")
+}
+
+func TestGetWeightedRandomService(t *testing.T) {
+	u := gounit.New(t)
+
+	entry := func(id string, tags ...string) *consulapi.ServiceEntry {
+		return &consulapi.ServiceEntry{
+			Node:    &consulapi.Node{Node: "node-1", Address: "10.0.0.1"},
+			Service: &consulapi.AgentService{ID: id, Service: "api", Port: 8080, Tags: tags},
+		}
+	}
+	entries := []*consulapi.ServiceEntry{
+		entry("light", "weight=1"),
+		entry("heavy", "weight=3", "canary"),
+		entry("default"),
+	}
+
+	client, srv, err := testutil.NewStubClient(stubServiceEntries(entries), consul.WithRandSource(rand.NewSource(1)))
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	const picks = 2000
+	counts := make(map[string]int)
+	for i := 0; i < picks; i++ {
+		addr, err := client.GetWeightedRandomService("api", "weight")
+		u.AssertNotError(err, "")
+		counts[addr.Service.ID]++
+	}
+
+	expected := map[string]float64{"light": 0.2, "heavy": 0.6, "default": 0.2}
+	for id, share := range expected {
+		got := float64(counts[id]) / picks
+		if math.Abs(got-share) > 0.05 {
+			t.Fatalf("%s picked %.2f of the time, expected %.2f", id, got, share)
+		}
+	}
+}
+
+func TestUpdateServiceTags(t *testing.T) {
+	u := gounit.New(t)
+
+	client, err := makeTestClient()
+	u.AssertNotError(err, "")
+
+	name := "tags-" + testKey()
+	err = client.RegisterServiceWithOptions(consul.ServiceOptions{
+		Name:    name,
+		Address: "127.0.0.1:8080",
+		Tags:    []string{"v1"},
+		Meta:    map[string]string{"team": "core"},
+		TTL:     30 * time.Second,
+		Status:  consulapi.HealthPassing,
+	})
+	u.AssertNotError(err, "")
+	defer client.DeRegisterService(name)
+
+	err = client.UpdateServiceTags(name, []string{"v2", "canary"})
+	u.AssertNotError(err, "")
+
+	entries, _, err := client.GetServices(name, "canary")
+	u.AssertNotError(err, "")
+	u.AssertEquals(1, len(entries), "passing instance with the new tag")
+	u.AssertEquals([]string{"v2", "canary"}, entries[0].Service.Tags, "")
+	u.AssertEquals("core", entries[0].Service.Meta["team"], "")
+
+	// the node check alone would keep the aggregated status passing
+	checks, err := client.Agent().Checks()
+	u.AssertNotError(err, "")
+	check, ok := checks["service:"+name]
+	u.AssertEquals(true, ok, "service check kept")
+	u.AssertEquals(consulapi.HealthPassing, check.Status, "")
+}
+
+func TestUpdateServiceTagsKeepsChecks(t *testing.T) {
+	u := gounit.New(t)
+
+	var reg consulapi.AgentServiceRegistration
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/agent/service/api":
+			json.NewEncoder(w).Encode(&consulapi.AgentService{ID: "api", Service: "api", Port: 8080})
+		case "/v1/agent/service/web":
+			json.NewEncoder(w).Encode(&consulapi.AgentService{ID: "web", Service: "web", Port: 8081})
+		case "/v1/agent/checks":
+			json.NewEncoder(w).Encode(map[string]*consulapi.AgentCheck{
+				"service:api": {CheckID: "service:api", ServiceID: "api", Type: "ttl", Status: consulapi.HealthPassing},
+				"service:web": {CheckID: "service:web", ServiceID: "web", Type: "ttl", Status: consulapi.HealthPassing},
+			})
+		case "/v1/agent/service/register":
+			json.NewDecoder(r.Body).Decode(&reg)
+		}
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	err = client.RegisterServiceWithOptions(consul.ServiceOptions{
+		Name:                   "api",
+		Address:                "127.0.0.1:8080",
+		TTL:                    30 * time.Second,
+		SuccessBeforePassing:   2,
+		FailuresBeforeCritical: 3,
+	})
+	u.AssertNotError(err, "")
+
+	u.AssertNotError(client.UpdateServiceTags("api", []string{"v2"}), "")
+	u.AssertEquals([]string{"v2"}, reg.Tags, "")
+	u.AssertEquals(1, len(reg.Checks), "only the checks of the service")
+	u.AssertEquals("service:api", reg.Checks[0].CheckID, "")
+	u.AssertEquals(consulapi.HealthPassing, reg.Checks[0].Status, "")
+	u.AssertEquals("30s", reg.Checks[0].TTL, "registered TTL kept")
+	u.AssertEquals(2, reg.Checks[0].SuccessBeforePassing, "")
+	u.AssertEquals(3, reg.Checks[0].FailuresBeforeCritical, "")
+
+	// a second update reuses the definitions of the first
+	u.AssertNotError(client.UpdateServiceTags("api", []string{"v3"}), "")
+	u.AssertEquals("30s", reg.Checks[0].TTL, "")
+
+	err = client.UpdateServiceTags("web", []string{"v2"})
+	u.AssertEquals(true, errors.Is(err, consul.ErrUnknownCheckTTL), "TTL check registered elsewhere")
+}
+
+func TestDNSName(t *testing.T) {
+	u := gounit.New(t)
+
+	entry := &consulapi.ServiceEntry{Service: &consulapi.AgentService{Service: "web"}}
+
+	u.AssertEquals("primary.web.service.dc1.consul", consul.DNSName(entry, "primary", "dc1"), "")
+	u.AssertEquals("web.service.dc1.consul", consul.DNSName(entry, "", "dc1"), "")
+	u.AssertEquals("web.service.consul", consul.DNSName(entry, "", ""), "")
+}
+
+func TestDiscoveryHook(t *testing.T) {
+	u := gounit.New(t)
+
+	handler := stubServiceEntries([]*consulapi.ServiceEntry{
+		{Service: &consulapi.AgentService{ID: "web-1", Service: "web", Address: "10.0.0.1", Port: 80}},
+		{Service: &consulapi.AgentService{ID: "web-2", Service: "web", Address: "10.0.0.2", Port: 80}},
+	})
+
+	type call struct {
+		service string
+		count   int
+		err     error
+	}
+	var calls []call
+	hook := func(service string, count int, d time.Duration, err error) {
+		calls = append(calls, call{service, count, err})
+	}
+
+	client, srv, err := testutil.NewStubClient(handler, consul.WithDiscoveryHook(hook))
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	_, _, err = client.GetServices("web", "")
+	u.AssertNotError(err, "")
+	_, _, err = client.GetFirstService("web", "")
+	u.AssertNotError(err, "")
+
+	u.AssertEquals(2, len(calls), "one call per discovery")
+	u.AssertEquals(call{"web", 2, nil}, calls[0], "")
+	u.AssertEquals(call{"web", 2, nil}, calls[1], "")
+}
+
+func TestPassTTLCheckID(t *testing.T) {
+	u := gounit.New(t)
+
+	client, err := makeTestClient()
+	u.AssertNotError(err, "")
+
+	name := "ttl-" + testKey()
+	err = client.RegisterServiceWithOptions(consul.ServiceOptions{
+		Name:    name,
+		Address: "127.0.0.1:8080",
+		CheckID: name + "-ttl",
+		TTL:     30 * time.Second,
+	})
+	u.AssertNotError(err, "")
+	defer client.DeRegisterService(name)
+
+	err = client.PassTTL(name+"-ttl", "alive")
+	u.AssertNotError(err, "")
+
+	entries, _, err := client.GetServices(name, "")
+	u.AssertNotError(err, "")
+	u.AssertEquals(1, len(entries), "passing after heartbeat")
+	for _, check := range entries[0].Checks {
+		if check.ServiceID == name {
+			u.AssertEquals(name+"-ttl", check.CheckID, "")
+			u.AssertEquals("alive", check.Output, "")
+		}
+	}
+}
+
+func TestResolver(t *testing.T) {
+	u := gounit.New(t)
+
+	client, err := makeTestClient()
+	u.AssertNotError(err, "")
+
+	name := "resolve-" + testKey()
+	defer registerPassing(t, &consulapi.AgentServiceRegistration{
+		ID:   name + "-1",
+		Name: name,
+		Port: 8081,
+	})()
+
+	r := client.Resolver(name, "")
+	defer r.Close()
+
+	addrs, err := r.Resolve()
+	u.AssertNotError(err, "")
+	u.AssertEquals([]string{"127.0.0.1:8081"}, addrs, "")
+
+	defer registerPassing(t, &consulapi.AgentServiceRegistration{
+		ID:   name + "-2",
+		Name: name,
+		Port: 8082,
+	})()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		addrs, err = r.Resolve()
+		u.AssertNotError(err, "")
+		if len(addrs) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("resolver not updated: %v", addrs)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestResolverEmpty(t *testing.T) {
+	u := gounit.New(t)
+
+	client, srv, err := testutil.NewStubClient(stubServiceEntries(nil))
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	r := client.Resolver("api", "")
+	defer r.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := r.Resolve()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		var insufficient consul.ErrInsufficientInstances
+		u.AssertEquals(true, errors.As(err, &insufficient), "errors.As ErrInsufficientInstances")
+	case <-time.After(5 * time.Second):
+		t.Fatal("resolve blocked without instances")
+	}
+}
+
+func TestResolverRetry(t *testing.T) {
+	u := gounit.New(t)
+
+	entry := func(id string, port int) *consulapi.ServiceEntry {
+		return &consulapi.ServiceEntry{
+			Node:    &consulapi.Node{Node: "node-1", Address: "10.0.0.1"},
+			Service: &consulapi.AgentService{ID: id, Service: "api", Port: port},
+		}
+	}
+	var mu sync.Mutex
+	calls := 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls++
+		n := calls
+		mu.Unlock()
+		switch {
+		case n == 1:
+			w.Header().Set("X-Consul-Index", "10")
+			json.NewEncoder(w).Encode([]*consulapi.ServiceEntry{entry("api-1", 8081)})
+		case n == 2:
+			http.Error(w, "transient failure", http.StatusInternalServerError)
+		case r.URL.Query().Get("index") == "11":
+			<-r.Context().Done()
+		default:
+			w.Header().Set("X-Consul-Index", "11")
+			json.NewEncoder(w).Encode([]*consulapi.ServiceEntry{entry("api-1", 8081), entry("api-2", 8082)})
+		}
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	r := client.Resolver("api", "")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		addrs, err := r.Resolve()
+		u.AssertNotError(err, "last passing instances kept after the failure")
+		if len(addrs) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("watch not re-established: %v", addrs)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	r.Close()
+	deadline = time.Now().Add(5 * time.Second)
+	for {
+		if _, err := r.Resolve(); err != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("resolve kept working after Close")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestRegisterServiceTaggedAddresses(t *testing.T) {
+	u := gounit.New(t)
+
+	client, err := makeTestClient()
+	u.AssertNotError(err, "")
+
+	name := "split-" + testKey()
+	err = client.RegisterServiceWithOptions(consul.ServiceOptions{
+		Name:    name,
+		Address: "10.0.0.1:8080",
+		Status:  consulapi.HealthPassing,
+		TaggedAddresses: map[string]string{
+			"lan": "10.0.0.1:8080",
+			"wan": "203.0.113.1:443",
+		},
+	})
+	u.AssertNotError(err, "")
+	defer client.DeRegisterService(name)
+
+	addrs, err := client.GetServiceTaggedAddress(name, "", "wan")
+	u.AssertNotError(err, "")
+	u.AssertEquals([]string{"203.0.113.1:443"}, addrs, "")
+
+	err = client.RegisterServiceWithOptions(consul.ServiceOptions{
+		Name:            name,
+		Address:         "10.0.0.1:8080",
+		TaggedAddresses: map[string]string{"wan": "203.0.113.1"},
+	})
+	u.AssertEquals(true, errors.Is(err, consul.ErrInvalidServiceAddr), "")
+}
+
+func TestGetActiveColorService(t *testing.T) {
+	u := gounit.New(t)
+
+	client, err := makeTestClient()
+	u.AssertNotError(err, "")
+
+	name := "color-" + testKey()
+	colorKey := testKey()
+	defer registerPassing(t, &consulapi.AgentServiceRegistration{
+		ID:   name + "-blue",
+		Name: name,
+		Tags: []string{"blue"},
+		Port: 8081,
+	})()
+	defer registerPassing(t, &consulapi.AgentServiceRegistration{
+		ID:   name + "-green",
+		Name: name,
+		Tags: []string{"green"},
+		Port: 8082,
+	})()
+
+	for _, color := range []string{"blue", "green"} {
+		_, err = client.Put(colorKey, color)
+		u.AssertNotError(err, "")
+
+		entries, err := client.GetActiveColorService(name, colorKey)
+		u.AssertNotError(err, color)
+		u.AssertEquals(1, len(entries), color)
+		u.AssertEquals(name+"-"+color, entries[0].Service.ID, "")
+	}
+}
+
+func TestRegisterHTTPService(t *testing.T) {
+	u := gounit.New(t)
+
+	regs := make(chan *consulapi.AgentServiceRegistration, 1)
+	client, srv, err := testutil.NewStubClient(stubRegistrations(regs))
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	err = client.RegisterHTTPService("web", "10.0.0.1:8080", "/healthz", 10*time.Second, "v1")
+	u.AssertNotError(err, "")
+
+	reg := <-regs
+	u.AssertEquals("http://10.0.0.1:8080/healthz", reg.Check.HTTP, "")
+	u.AssertEquals("10s", reg.Check.Interval, "")
+	u.AssertEquals("5s", reg.Check.Timeout, "")
+	u.AssertEquals([]string{"v1"}, reg.Tags, "")
+
+	err = client.RegisterHTTPService("web", "10.0.0.1:8080", "healthz", 10*time.Second)
+	u.AssertEquals(true, errors.Is(err, consul.ErrInvalidCheckOptions), "")
+}
+
+func TestGetServicesWithFallback(t *testing.T) {
+	u := gounit.New(t)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "rpc error", http.StatusInternalServerError)
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	entries, err := client.GetServicesWithFallback("web", "", []string{"10.0.0.1:80", "10.0.0.2:80"})
+	u.AssertNotError(err, "")
+	u.AssertEquals(2, len(entries), "")
+	u.AssertEquals("web", entries[0].Service.Service, "")
+	u.AssertEquals("10.0.0.1", entries[0].Service.Address, "")
+	u.AssertEquals(80, entries[1].Service.Port, "")
+
+	_, err = client.GetServicesWithFallback("web", "", []string{"10.0.0.1"})
+	u.AssertEquals(true, errors.Is(err, consul.ErrInvalidServiceAddr), "")
+}
+
+func TestServiceTags(t *testing.T) {
+	u := gounit.New(t)
+
+	var passing bool
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		passing = r.URL.Query().Has("passing")
+		stubServiceEntries([]*consulapi.ServiceEntry{
+			{Service: &consulapi.AgentService{ID: "web-1", Tags: []string{"v2", "canary"}}},
+			{Service: &consulapi.AgentService{ID: "web-2", Tags: []string{"v1", "v2"}}},
+			{Service: &consulapi.AgentService{ID: "web-3"}},
+		}).ServeHTTP(w, r)
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	tags, err := client.ServiceTags("web")
+	u.AssertNotError(err, "")
+	u.AssertEquals([]string{"canary", "v1", "v2"}, tags, "")
+	u.AssertEquals(false, passing, "all instances")
+}
+
+func TestWaitForRegistration(t *testing.T) {
+	u := gounit.New(t)
+
+	client, err := testutil.NewClient(consul.WaitForRegistration(5 * time.Second))
+	u.AssertNotError(err, "")
+
+	name := "registered-" + testKey()
+	err = client.RegisterServiceWithOptions(consul.ServiceOptions{
+		Name:    name,
+		Address: "127.0.0.1:8080",
+		Status:  consulapi.HealthPassing,
+		TTL:     30 * time.Second,
+	})
+	u.AssertNotError(err, "")
+	defer client.DeRegisterService(name)
+
+	addrs, _, err := client.GetServices(name, "")
+	u.AssertNotError(err, "")
+	u.AssertEquals(1, len(addrs), "visible right after registration")
+}
+
+func TestRegisterServiceForListener(t *testing.T) {
+	u := gounit.New(t)
+
+	client, err := makeTestClient()
+	u.AssertNotError(err, "")
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	u.AssertNotError(err, "")
+	defer ln.Close()
+
+	name := "listener-" + testKey()
+	err = client.RegisterServiceForListener(name, ln)
+	u.AssertNotError(err, "")
+	defer client.DeRegisterService(name)
+
+	entries, _, err := client.Health().Service(name, "", false, nil)
+	u.AssertNotError(err, "")
+	u.AssertEquals(1, len(entries), "")
+	u.AssertEquals(ln.Addr().(*net.TCPAddr).Port, entries[0].Service.Port, "bound port")
+}
+
+// heartbeatGoroutines counts the goroutines running a HeartbeatManager
+func heartbeatGoroutines() int {
+	buf := make([]byte, 1<<20)
+	buf = buf[:runtime.Stack(buf, true)]
+	return strings.Count(string(buf), "(*HeartbeatManager).run(")
+}
+
+func TestRegisterServiceWithHeartbeat(t *testing.T) {
+	u := gounit.New(t)
+
+	var mu sync.Mutex
+	updates := make(map[string]int)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if id, ok := strings.CutPrefix(r.URL.Path, "/v1/agent/check/update/"); ok {
+			var update struct{ Status string }
+			json.NewDecoder(r.Body).Decode(&update)
+			mu.Lock()
+			if update.Status != consulapi.HealthPassing {
+				id += " " + update.Status
+			}
+			updates[id]++
+			mu.Unlock()
+		}
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	names := []string{"api", "worker", "cron"}
+	for _, name := range names {
+		err = client.RegisterServiceWithHeartbeat(consul.ServiceOptions{
+			Name:    name,
+			Address: "127.0.0.1:8080",
+			TTL:     100 * time.Millisecond,
+		})
+		u.AssertNotError(err, "")
+	}
+	u.AssertEquals(1, heartbeatGoroutines(), "single heartbeat goroutine")
+
+	time.Sleep(300 * time.Millisecond)
+	mu.Lock()
+	for _, name := range names {
+		u.AssertEquals(true, updates["service:"+name] >= 3, name)
+	}
+	mu.Unlock()
+
+	for _, name := range names {
+		u.AssertNotError(client.DeRegisterService(name), "")
+	}
+	time.Sleep(100 * time.Millisecond)
+	u.AssertEquals(0, heartbeatGoroutines(), "stopped without checks")
+
+	err = client.RegisterServiceWithHeartbeat(consul.ServiceOptions{
+		Name:    "api",
+		Address: "127.0.0.1:8080",
+		TTL:     time.Nanosecond,
+	})
+	u.AssertEquals(true, errors.Is(err, consul.ErrInvalidCheckOptions), "TTL too short")
+	err = client.Heartbeats().Add("service:api", 0)
+	u.AssertEquals(true, errors.Is(err, consul.ErrInvalidCheckOptions), "non-positive interval")
+	u.AssertEquals(0, heartbeatGoroutines(), "")
+}
+
+func TestExportImportServices(t *testing.T) {
+	u := gounit.New(t)
+
+	client, err := makeTestClient()
+	u.AssertNotError(err, "")
+
+	name := "backup-" + testKey()
+	err = client.RegisterServiceWithOptions(consul.ServiceOptions{
+		Name:                   name,
+		Address:                "127.0.0.1:8080",
+		Meta:                   map[string]string{"version": "1.2.0"},
+		Status:                 consulapi.HealthPassing,
+		TTL:                    30 * time.Second,
+		FailuresBeforeCritical: 2,
+	})
+	u.AssertNotError(err, "")
+	defer client.DeRegisterService(name)
+
+	data, err := client.ExportServices()
+	u.AssertNotError(err, "")
+
+	var regs []*consulapi.AgentServiceRegistration
+	u.AssertNotError(json.Unmarshal(data, &regs), "")
+	var exported *consulapi.AgentServiceRegistration
+	for _, reg := range regs {
+		if reg.ID == name {
+			exported = reg
+		}
+	}
+	u.AssertNotNil(exported, "service exported")
+	u.AssertEquals(1, len(exported.Checks), "")
+	u.AssertEquals("30s", exported.Checks[0].TTL, "registered TTL exported")
+	u.AssertEquals(2, exported.Checks[0].FailuresBeforeCritical, "")
+
+	u.AssertNotError(client.DeRegisterService(name), "")
+	_, _, err = client.Agent().Service(name, nil)
+	u.AssertEquals(true, err != nil, "deregistered")
+
+	u.AssertNotError(client.ImportServices(data), "")
+
+	svc, _, err := client.Agent().Service(name, nil)
+	u.AssertNotError(err, "")
+	u.AssertEquals("1.2.0", svc.Meta["version"], "meta preserved")
+
+	checks, err := client.Agent().Checks()
+	u.AssertNotError(err, "")
+	check, ok := checks["service:"+name]
+	u.AssertEquals(true, ok, "check preserved")
+	u.AssertEquals("ttl", check.Type, "")
+}
+
+func TestExportServicesUnknownTTL(t *testing.T) {
+	u := gounit.New(t)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/agent/services":
+			json.NewEncoder(w).Encode(map[string]*consulapi.AgentService{
+				"web": {ID: "web", Service: "web", Port: 8081},
+			})
+		case "/v1/agent/checks":
+			json.NewEncoder(w).Encode(map[string]*consulapi.AgentCheck{
+				"service:web": {CheckID: "service:web", ServiceID: "web", Type: "ttl", Status: consulapi.HealthPassing},
+			})
+		}
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	_, err = client.ExportServices()
+	u.AssertEquals(true, errors.Is(err, consul.ErrUnknownCheckTTL), "TTL check registered elsewhere")
+}
+
+func TestGetFirstLocalService(t *testing.T) {
+	u := gounit.New(t)
+
+	entries := stubServiceEntries([]*consulapi.ServiceEntry{
+		{Node: &consulapi.Node{Node: "remote"}, Service: &consulapi.AgentService{ID: "api-remote"}},
+		{Node: &consulapi.Node{Node: "local"}, Service: &consulapi.AgentService{ID: "api-local"}},
+	})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/agent/self" {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"Config": map[string]interface{}{"NodeName": "local"},
+			})
+			return
+		}
+		entries.ServeHTTP(w, r)
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	entry, _, err := client.GetFirstLocalService("api", "")
+	u.AssertNotError(err, "")
+	u.AssertEquals("api-local", entry.Service.ID, "local instance preferred")
+}
+
+func TestDrainAndDeregister(t *testing.T) {
+	u := gounit.New(t)
+
+	client, err := makeTestClient()
+	u.AssertNotError(err, "")
+
+	name := "drain-" + testKey()
+	defer registerPassing(t, &consulapi.AgentServiceRegistration{
+		ID:   name,
+		Name: name,
+	})()
+
+	addrs, _, err := client.GetServices(name, "")
+	u.AssertNotError(err, "")
+	u.AssertEquals(1, len(addrs), "passing before drain")
+
+	done := make(chan error, 1)
+	go func() {
+		done <- client.DrainAndDeregister(context.Background(), name, 2*time.Second)
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for len(addrs) > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		addrs, _, err = client.GetServices(name, "")
+		u.AssertNotError(err, "")
+	}
+	u.AssertEquals(0, len(addrs), "left passing discovery")
+
+	_, _, err = client.Agent().Service(name, nil)
+	u.AssertNotError(err, "still registered during grace")
+
+	u.AssertNotError(<-done, "")
+	_, _, err = client.Agent().Service(name, nil)
+	u.AssertEquals(true, err != nil, "deregistered after grace")
+}
+
+func TestRegisterServiceHeartbeat(t *testing.T) {
+	u := gounit.New(t)
+
+	var mu sync.Mutex
+	updates := 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/agent/check/update/service:api" {
+			mu.Lock()
+			updates++
+			mu.Unlock()
+		}
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	u.AssertNotError(client.RegisterService("api", "127.0.0.1:8080"), "")
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	u.AssertEquals(1, updates, "passed on registration")
+	mu.Unlock()
+	u.AssertEquals(1, heartbeatGoroutines(), "")
+
+	client.StopHeartbeat("api")
+	time.Sleep(100 * time.Millisecond)
+	u.AssertEquals(0, heartbeatGoroutines(), "stopped")
+}
@@ -0,0 +1,239 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/l-vitaly/consul"
+	"github.com/l-vitaly/gounit"
+)
+
+func TestSessionKeepAliveLost(t *testing.T) {
+	u := gounit.New(t)
+
+	client, err := makeTestClient()
+	u.AssertNotError(err, "")
+
+	raw, err := consulapi.NewClient(consulapi.DefaultConfig())
+	u.AssertNotError(err, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	id, lost, err := client.SessionKeepAlive(ctx, 10*time.Second)
+	u.AssertNotError(err, "")
+
+	select {
+	case <-lost:
+		t.Fatal("session lost before destroy")
+	default:
+	}
+
+	_, err = raw.Session().Destroy(id, nil)
+	u.AssertNotError(err, "")
+
+	select {
+	case <-lost:
+	case <-time.After(20 * time.Second):
+		t.Fatal("lost was not closed after destroy")
+	}
+}
+
+func TestGetWithSession(t *testing.T) {
+	u := gounit.New(t)
+
+	key := testKey()
+
+	client, err := makeTestClient()
+	u.AssertNotError(err, "")
+
+	raw, err := consulapi.NewClient(consulapi.DefaultConfig())
+	u.AssertNotError(err, "")
+
+	_, err = client.Put(key, "unlocked")
+	u.AssertNotError(err, "")
+
+	value, session, err := client.GetWithSession(key)
+	u.AssertNotError(err, "")
+	u.AssertEquals("unlocked", value, "")
+	u.AssertEquals("", session, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	id, _, err := client.SessionKeepAlive(ctx, 10*time.Second)
+	u.AssertNotError(err, "")
+
+	acquired, _, err := raw.KV().Acquire(&consulapi.KVPair{Key: key, Value: []byte("locked"), Session: id}, nil)
+	u.AssertNotError(err, "")
+	u.AssertEquals(true, acquired, "")
+
+	value, session, err = client.GetWithSession(key)
+	u.AssertNotError(err, "")
+	u.AssertEquals("locked", value, "")
+	u.AssertEquals(id, session, "")
+}
+
+// crashedSessionEnv makes TestDestroyOrphanedSessions run as the process
+// leaving an orphaned session: it acquires the key with a kept-alive session
+// and exits without destroying it
+const crashedSessionEnv = "CONSUL_TEST_CRASHED_SESSION_KEY"
+
+func TestDestroyOrphanedSessions(t *testing.T) {
+	if key := os.Getenv(crashedSessionEnv); key != "" {
+		client, err := makeTestClient()
+		if err != nil {
+			os.Exit(1)
+		}
+		id, _, err := client.SessionKeepAlive(context.Background(), 10*time.Second)
+		if err != nil {
+			os.Exit(1)
+		}
+		kv := &consulapi.KVPair{Key: key, Value: []byte("locked"), Session: id}
+		if acquired, _, err := client.KV().Acquire(kv, nil); err != nil || !acquired {
+			os.Exit(1)
+		}
+		fmt.Println("session=" + id)
+		os.Exit(0)
+	}
+
+	u := gounit.New(t)
+
+	key := testKey()
+
+	client, err := makeTestClient()
+	u.AssertNotError(err, "")
+	defer client.Delete(key)
+
+	// the session of another live client, still renewed
+	live, err := makeTestClient()
+	u.AssertNotError(err, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	alive, _, err := live.SessionKeepAlive(ctx, 10*time.Second)
+	u.AssertNotError(err, "")
+	own, _, err := client.SessionKeepAlive(ctx, 10*time.Second)
+	u.AssertNotError(err, "")
+
+	// the session of a crashed process, no longer renewed
+	cmd := exec.Command(os.Args[0], "-test.run=^TestDestroyOrphanedSessions$")
+	cmd.Env = append(os.Environ(), crashedSessionEnv+"="+key)
+	out, err := cmd.Output()
+	u.AssertNotError(err, "")
+	var orphan string
+	for _, line := range strings.Split(string(out), "\n") {
+		if id, ok := strings.CutPrefix(line, "session="); ok {
+			orphan = id
+		}
+	}
+	u.AssertEquals(true, orphan != "", "orphaned session created")
+
+	n, err := client.DestroyOrphanedSessions(0)
+	u.AssertNotError(err, "")
+	u.AssertEquals(true, n >= 1, "destroyed sessions")
+
+	sessions, err := client.ListSessions()
+	u.AssertNotError(err, "")
+	ids := make(map[string]bool)
+	for _, s := range sessions {
+		ids[s.ID] = true
+	}
+	u.AssertEquals(false, ids[orphan], "orphan destroyed")
+	u.AssertEquals(true, ids[alive], "session of a live client kept")
+	u.AssertEquals(true, ids[own], "own session kept")
+
+	_, session, err := client.GetWithSession(key)
+	u.AssertNotError(err, "")
+	u.AssertEquals("", session, "lock released")
+}
+
+func TestLock(t *testing.T) {
+	u := gounit.New(t)
+
+	key := testKey()
+
+	client, err := makeTestClient()
+	u.AssertNotError(err, "")
+	defer client.Delete(key)
+
+	lock, err := client.Lock(key, consul.WithLockValue([]byte("worker-1")))
+	u.AssertNotError(err, "")
+
+	value, session, err := client.GetWithSession(key)
+	u.AssertNotError(err, "")
+	u.AssertEquals("worker-1", value, "")
+	u.AssertEquals(true, session != "", "held by a session")
+
+	_, err = client.Lock(key, consul.WithLockWait(200*time.Millisecond))
+	u.AssertEquals(true, errors.Is(err, consul.ErrLockNotAcquired), "held elsewhere")
+
+	u.AssertNotError(lock.Unlock(), "")
+	select {
+	case <-lock.Lost():
+		t.Fatal("lost closed by unlock")
+	default:
+	}
+
+	second, err := client.Lock(key, consul.WithLockWait(time.Second))
+	u.AssertNotError(err, "acquired after unlock")
+
+	// deleting the key makes the holder lose the lock
+	_, err = client.Delete(key)
+	u.AssertNotError(err, "")
+	select {
+	case <-second.Lost():
+	case <-time.After(10 * time.Second):
+		t.Fatal("lost was not closed")
+	}
+	u.AssertNotError(second.Unlock(), "")
+}
+
+func TestLeaderElection(t *testing.T) {
+	u := gounit.New(t)
+
+	key := testKey()
+
+	client, err := makeTestClient()
+	u.AssertNotError(err, "")
+	defer client.Delete(key)
+
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	defer cancel1()
+	first := consul.NewLeaderElection(client, key, "node-1")
+	go first.Run(ctx1)
+	select {
+	case ev := <-first.Events():
+		u.AssertEquals(consul.IsLeader, ev, "")
+	case <-time.After(30 * time.Second):
+		t.Fatal("leadership was not acquired")
+	}
+
+	value, err := client.GetStr(key)
+	u.AssertNotError(err, "")
+	u.AssertEquals("node-1", value, "")
+
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	defer cancel2()
+	second := consul.NewLeaderElection(client, key, "node-2")
+	go second.Run(ctx2)
+
+	// giving up the leadership hands it over to the other candidate
+	cancel1()
+	for range first.Events() {
+	}
+	select {
+	case ev := <-second.Events():
+		u.AssertEquals(consul.IsLeader, ev, "")
+	case <-time.After(30 * time.Second):
+		t.Fatal("leadership was not handed over")
+	}
+}
@@ -0,0 +1,34 @@
+package test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/l-vitaly/consul"
+	"github.com/l-vitaly/consul/testutil"
+	"github.com/l-vitaly/gounit"
+)
+
+func TestWatchLeader(t *testing.T) {
+	u := gounit.New(t)
+
+	client, err := testutil.NewClient(consul.WithLeaderPollInterval(100 * time.Millisecond))
+	u.AssertNotError(err, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := client.WatchLeader(ctx)
+
+	select {
+	case leader := <-ch:
+		u.AssertEquals(true, leader != "", "leader address")
+	case <-time.After(5 * time.Second):
+		t.Fatal("no leader emitted")
+	}
+
+	cancel()
+	for range ch {
+	}
+}
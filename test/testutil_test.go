@@ -0,0 +1,48 @@
+package test
+
+import (
+	"testing"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/l-vitaly/consul"
+	"github.com/l-vitaly/consul/testutil"
+	"github.com/l-vitaly/gounit"
+)
+
+func TestSeed(t *testing.T) {
+	u := gounit.New(t)
+
+	client, err := makeTestClient()
+	u.AssertNotError(err, "")
+
+	prefix := testKey()
+	name := "seed-" + testKey()
+
+	kv := map[string]string{
+		prefix + "/name": "seeded",
+		prefix + "/size": "10",
+	}
+	services := []consul.ServiceOptions{
+		{Name: name, Address: "127.0.0.1:8080", TTL: 30 * time.Second, Status: consulapi.HealthPassing},
+	}
+
+	err = testutil.Seed(client, kv, services)
+	u.AssertNotError(err, "")
+
+	v, err := client.GetStr(prefix + "/name")
+	u.AssertNotError(err, "")
+	u.AssertEquals("seeded", v, "")
+
+	addrs, _, err := client.GetServices(name, "")
+	u.AssertNotError(err, "")
+	u.AssertEquals(1, len(addrs), "")
+	u.AssertEquals(8080, addrs[0].Service.Port, "")
+
+	err = testutil.Cleanup(client, kv, services)
+	u.AssertNotError(err, "")
+
+	_, err = client.GetStr(prefix + "/name")
+	_, ok := err.(consul.ErrKVNotFound)
+	u.AssertEquals(true, ok, "key removed")
+}
@@ -0,0 +1,963 @@
+package test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/l-vitaly/consul"
+	"github.com/l-vitaly/consul/testutil"
+	"github.com/l-vitaly/gounit"
+)
+
+func TestWatchStructMap(t *testing.T) {
+	u := gounit.New(t)
+
+	parent := testKey()
+
+	client, err := makeTestClient()
+	u.AssertNotError(err, "")
+
+	raw, err := consulapi.NewClient(consulapi.DefaultConfig())
+	u.AssertNotError(err, "")
+
+	type plugin struct {
+		Name string
+	}
+
+	_, err = client.Put(parent+"/first/name", "first plugin")
+	u.AssertNotError(err, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch, err := client.WatchStructMap(ctx, parent, func() interface{} {
+		return &plugin{}
+	})
+	u.AssertNotError(err, "")
+
+	next := func() map[string]interface{} {
+		select {
+		case m := <-ch:
+			return m
+		case <-time.After(5 * time.Second):
+			t.Fatal("no struct map emitted")
+		}
+		return nil
+	}
+
+	m := next()
+	u.AssertEquals(1, len(m), "initial")
+	u.AssertEquals("first plugin", m["first"].(*plugin).Name, "")
+
+	_, err = client.Put(parent+"/second/name", "second plugin")
+	u.AssertNotError(err, "")
+
+	m = next()
+	u.AssertEquals(2, len(m), "child added")
+	u.AssertEquals("second plugin", m["second"].(*plugin).Name, "")
+
+	_, err = raw.KV().DeleteTree(parent+"/first", nil)
+	u.AssertNotError(err, "")
+
+	m = next()
+	u.AssertEquals(1, len(m), "child removed")
+	_, ok := m["first"]
+	u.AssertEquals(false, ok, "")
+}
+
+func TestWatchServicesFiltered(t *testing.T) {
+	u := gounit.New(t)
+
+	client, err := makeTestClient()
+	u.AssertNotError(err, "")
+
+	name := "watch-" + testKey()
+	defer registerPassing(t, &consulapi.AgentServiceRegistration{
+		ID:   name + "-canary-1",
+		Name: name,
+		Meta: map[string]string{"track": "canary"},
+	})()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := client.WatchServicesFiltered(ctx, name, "", `Service.Meta.track == "canary"`)
+
+	next := func() []*consulapi.ServiceEntry {
+		select {
+		case addrs := <-ch:
+			return addrs
+		case <-time.After(5 * time.Second):
+			t.Fatal("no services emitted")
+		}
+		return nil
+	}
+
+	u.AssertEquals(1, len(next()), "initial")
+
+	defer registerPassing(t, &consulapi.AgentServiceRegistration{
+		ID:   name + "-stable",
+		Name: name,
+		Meta: map[string]string{"track": "stable"},
+	})()
+
+	select {
+	case addrs := <-ch:
+		t.Fatalf("emitted on a non matching instance: %d instances", len(addrs))
+	case <-time.After(time.Second):
+	}
+
+	defer registerPassing(t, &consulapi.AgentServiceRegistration{
+		ID:   name + "-canary-2",
+		Name: name,
+		Meta: map[string]string{"track": "canary"},
+	})()
+
+	addrs := next()
+	u.AssertEquals(2, len(addrs), "canary added")
+	for _, addr := range addrs {
+		u.AssertEquals("canary", addr.Service.Meta["track"], addr.Service.ID)
+	}
+}
+
+func TestWatchIndexHook(t *testing.T) {
+	u := gounit.New(t)
+
+	key := testKey()
+
+	type progression struct {
+		old, new uint64
+	}
+	var mu sync.Mutex
+	var indexes []progression
+
+	client, err := testutil.NewClient(consul.WithWatchIndexHook(func(k string, oldIndex, newIndex uint64) {
+		if k != key {
+			return
+		}
+		mu.Lock()
+		indexes = append(indexes, progression{oldIndex, newIndex})
+		mu.Unlock()
+	}))
+	u.AssertNotError(err, "")
+
+	_, err = client.Put(key, "first")
+	u.AssertNotError(err, "")
+
+	ch := client.WatchGet(key)
+	<-ch
+
+	_, err = client.Put(key, "second")
+	u.AssertNotError(err, "")
+	<-ch
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	u.AssertEquals(true, len(indexes) >= 2, "hook called each cycle")
+	u.AssertEquals(uint64(0), indexes[0].old, "first query does not block")
+	for i := 1; i < len(indexes); i++ {
+		u.AssertEquals(indexes[i-1].new, indexes[i].old, "wait index follows the last index")
+	}
+	last := indexes[len(indexes)-1]
+	u.AssertEquals(true, last.new > last.old, "index advanced on put")
+}
+
+func TestWatchStructDebounced(t *testing.T) {
+	u := gounit.New(t)
+
+	parent := testKey()
+
+	client, err := makeTestClient()
+	u.AssertNotError(err, "")
+
+	_, err = client.Put(parent+"/name", "v0")
+	u.AssertNotError(err, "")
+
+	var mu sync.RWMutex
+	var s struct {
+		Name string
+	}
+	ch, err := client.WatchStructDebounced(parent, &s, &mu, 500*time.Millisecond)
+	u.AssertNotError(err, "")
+	u.AssertEquals("v0", s.Name, "initial load")
+
+	for i := 1; i <= 5; i++ {
+		_, err = client.Put(parent+"/name", fmt.Sprintf("v%d", i))
+		u.AssertNotError(err, "")
+	}
+
+	reloads := 0
+	timeout := time.After(3 * time.Second)
+loop:
+	for {
+		select {
+		case <-ch:
+			reloads++
+		case <-timeout:
+			break loop
+		}
+	}
+	u.AssertEquals(1, reloads, "single reload")
+	mu.RLock()
+	defer mu.RUnlock()
+	u.AssertEquals("v5", s.Name, "")
+}
+
+func TestWatchMaxLifetime(t *testing.T) {
+	u := gounit.New(t)
+
+	key := testKey()
+
+	var mu sync.Mutex
+	var blocked []string
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		index := r.URL.Query().Get("index")
+		if index != "" {
+			// a query stuck on a dead connection never returns
+			mu.Lock()
+			blocked = append(blocked, index)
+			mu.Unlock()
+			<-r.Context().Done()
+			return
+		}
+		w.Header().Set("X-Consul-Index", "10")
+		w.Write(stubKVPair(key, "value", 10))
+	})
+
+	client, srv, err := testutil.NewStubClient(handler, consul.WithWatchMaxLifetime(200*time.Millisecond))
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	ch := client.WatchGet(key)
+	<-ch
+
+	time.Sleep(time.Second)
+
+	mu.Lock()
+	defer mu.Unlock()
+	u.AssertEquals(true, len(blocked) >= 3, "query re-issued after max lifetime")
+	for _, index := range blocked {
+		u.AssertEquals("10", index, "re-issued with the same index")
+	}
+}
+
+func TestWatchTreeBatched(t *testing.T) {
+	u := gounit.New(t)
+
+	prefix := testKey()
+
+	client, err := makeTestClient()
+	u.AssertNotError(err, "")
+
+	_, err = client.Put(prefix+"/existing", "0")
+	u.AssertNotError(err, "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := client.WatchTreeBatched(ctx, prefix, time.Second)
+	time.Sleep(100 * time.Millisecond)
+
+	for i := 1; i <= 3; i++ {
+		_, err = client.Put(fmt.Sprintf("%s/key-%d", prefix, i), "v")
+		u.AssertNotError(err, "")
+	}
+
+	select {
+	case batch := <-ch:
+		u.AssertEquals(3, len(batch), "single batch")
+		u.AssertEquals(prefix+"/key-1", batch[0].Key, "")
+	case <-time.After(5 * time.Second):
+		t.Fatal("no batch delivered")
+	}
+
+	select {
+	case batch := <-ch:
+		t.Fatalf("unexpected second batch of %d pairs", len(batch))
+	case <-time.After(1500 * time.Millisecond):
+	}
+}
+
+func TestWatchTreeEventsRenamed(t *testing.T) {
+	u := gounit.New(t)
+
+	list := func(w http.ResponseWriter, index string, pairs ...*consulapi.KVPair) {
+		w.Header().Set("X-Consul-Index", index)
+		json.NewEncoder(w).Encode(pairs)
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("index") {
+		case "":
+			list(w, "10",
+				&consulapi.KVPair{Key: "app/db_host", Value: []byte("db.local"), ModifyIndex: 5},
+				&consulapi.KVPair{Key: "app/port", Value: []byte("80"), ModifyIndex: 6})
+		case "10":
+			// db_host renamed to database/host and port modified in one change
+			list(w, "11",
+				&consulapi.KVPair{Key: "app/database/host", Value: []byte("db.local"), ModifyIndex: 11},
+				&consulapi.KVPair{Key: "app/port", Value: []byte("8080"), ModifyIndex: 11})
+		default:
+			<-r.Context().Done()
+		}
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := client.WatchTreeEvents(ctx, "app", consul.WatchTreeOptions{DetectRenames: true})
+
+	var events []consul.TreeEvent
+	for len(events) < 2 {
+		select {
+		case e := <-ch:
+			events = append(events, e)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d events, want 2", len(events))
+		}
+	}
+
+	u.AssertEquals("app/database/host", events[0].Key, "")
+	u.AssertEquals(&consul.Renamed{Old: "app/db_host", New: "app/database/host"}, events[0].Renamed, "")
+	u.AssertEquals("app/port", events[1].Key, "")
+	u.AssertEquals("8080", string(events[1].KV.Value), "")
+	u.AssertEquals(true, events[1].Renamed == nil, "")
+}
+
+func TestWatchServiceTags(t *testing.T) {
+	u := gounit.New(t)
+
+	client, err := makeTestClient()
+	u.AssertNotError(err, "")
+
+	name := "retag-" + testKey()
+	defer registerPassing(t, &consulapi.AgentServiceRegistration{
+		ID:   name,
+		Name: name,
+		Tags: []string{"canary"},
+	})()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := client.WatchServiceTags(ctx, name)
+
+	next := func() map[string][]string {
+		select {
+		case tags := <-ch:
+			return tags
+		case <-time.After(5 * time.Second):
+			t.Fatal("no tags emitted")
+		}
+		return nil
+	}
+
+	u.AssertEquals(map[string][]string{name: {"canary"}}, next(), "initial")
+
+	err = client.UpdateServiceTags(name, []string{"stable"})
+	u.AssertNotError(err, "")
+
+	u.AssertEquals(map[string][]string{name: {"stable"}}, next(), "re-tagged")
+}
+
+func TestWatchConsistent(t *testing.T) {
+	u := gounit.New(t)
+
+	queries := make(chan bool, 10)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.Query().Has("consistent")
+		if r.URL.Query().Has("index") {
+			<-r.Context().Done()
+			return
+		}
+		w.Header().Set("X-Consul-Index", "10")
+		w.Write(stubKVPair("service/name", "api", 10))
+	})
+
+	client, srv, err := testutil.NewStubClient(handler, consul.WithConsistentWatches())
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	ch, stop := client.WatchGetStoppable("service/name")
+	defer stop()
+
+	select {
+	case <-ch:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no value delivered")
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case consistent := <-queries:
+			u.AssertEquals(true, consistent, fmt.Sprintf("query %d", i))
+		case <-time.After(5 * time.Second):
+			t.Fatal("no watch query")
+		}
+	}
+}
+
+func TestWatchStructMapInitialList(t *testing.T) {
+	u := gounit.New(t)
+
+	queries := make(chan bool, 1)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case queries <- r.URL.Query().Has("consistent"):
+		default:
+		}
+		http.Error(w, "No cluster leader", http.StatusInternalServerError)
+	})
+
+	client, srv, err := testutil.NewStubClient(handler, consul.WithConsistentWatches())
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	_, err = client.WatchStructMap(context.Background(), "plugins", func() interface{} {
+		return &struct{ Name string }{}
+	})
+	u.AssertEquals(true, errors.Is(err, consul.ErrNoClusterLeader), "")
+	u.AssertEquals(true, <-queries, "initial list read like the watch queries")
+}
+
+func TestMultiplex(t *testing.T) {
+	u := gounit.New(t)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("index") {
+			<-r.Context().Done()
+			return
+		}
+		w.Header().Set("X-Consul-Index", "10")
+		if strings.HasPrefix(r.URL.Path, "/v1/kv/") {
+			w.Write(stubKVPair("flags/new-ui", "true", 10))
+			return
+		}
+		json.NewEncoder(w).Encode([]*consulapi.ServiceEntry{
+			{Node: &consulapi.Node{Node: "n1"}, Service: &consulapi.AgentService{ID: "backend-1", Address: "10.0.0.1", Port: 80}},
+		})
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	flag, stop := client.WatchGetStoppable("flags/new-ui")
+	defer stop()
+
+	m := consul.Multiplex(
+		consul.Source("flag", flag),
+		consul.Source("backend", client.WatchServices(ctx, "backend", "")),
+	)
+
+	got := make(map[string]consul.Event)
+	for len(got) < 2 {
+		select {
+		case e := <-m.Events():
+			got[e.Source] = e
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d events, want 2", len(got))
+		}
+	}
+
+	u.AssertEquals("true", string(got["flag"].Value.(*consulapi.KVPair).Value), "")
+	u.AssertEquals("backend-1", got["backend"].Value.([]*consulapi.ServiceEntry)[0].Service.ID, "")
+
+	m.Close()
+	select {
+	case _, ok := <-m.Events():
+		u.AssertEquals(false, ok, "events closed")
+	case <-time.After(5 * time.Second):
+		t.Fatal("events not closed")
+	}
+}
+
+func TestWatchServicesEmpty(t *testing.T) {
+	u := gounit.New(t)
+
+	client, srv, err := testutil.NewStubClient(stubServiceEntries(nil))
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	select {
+	case addrs := <-client.WatchServices(ctx, "api", ""):
+		u.AssertEquals(0, len(addrs), "no instances emitted on start")
+	case <-time.After(5 * time.Second):
+		t.Fatal("nothing emitted on start")
+	}
+}
+
+func TestWatchTreeDiff(t *testing.T) {
+	u := gounit.New(t)
+
+	list := func(w http.ResponseWriter, index string, pairs ...*consulapi.KVPair) {
+		w.Header().Set("X-Consul-Index", index)
+		json.NewEncoder(w).Encode(pairs)
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("index") {
+		case "":
+			list(w, "10",
+				&consulapi.KVPair{Key: "app/host", Value: []byte("db.local"), ModifyIndex: 5},
+				&consulapi.KVPair{Key: "app/port", Value: []byte("80"), ModifyIndex: 6})
+		case "10":
+			list(w, "11",
+				&consulapi.KVPair{Key: "app/host", Value: []byte("db.local"), ModifyIndex: 5},
+				&consulapi.KVPair{Key: "app/port", Value: []byte("8080"), ModifyIndex: 11})
+		default:
+			<-r.Context().Done()
+		}
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	initial, ch, err := client.WatchTreeDiff(ctx, "app")
+	u.AssertNotError(err, "")
+	u.AssertEquals(2, len(initial), "full initial set")
+
+	select {
+	case diff := <-ch:
+		u.AssertEquals(0, len(diff.Added), "")
+		u.AssertEquals(0, len(diff.Deleted), "")
+		u.AssertEquals(1, len(diff.Modified), "")
+		u.AssertEquals("app/port", diff.Modified[0].Key, "")
+		u.AssertEquals("8080", string(diff.Modified[0].Value), "")
+	case <-time.After(5 * time.Second):
+		t.Fatal("no diff emitted")
+	}
+}
+
+func TestMirrorToFile(t *testing.T) {
+	u := gounit.New(t)
+
+	put := make(chan struct{})
+	del := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("index") {
+		case "":
+			w.Header().Set("X-Consul-Index", "10")
+			w.Write(stubKVPair("app/token", "first", 10))
+		case "10":
+			<-put
+			w.Header().Set("X-Consul-Index", "11")
+			w.Write(stubKVPair("app/token", "second", 11))
+		case "11":
+			<-del
+			w.Header().Set("X-Consul-Index", "12")
+			http.NotFound(w, r)
+		default:
+			<-r.Context().Done()
+		}
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	path := filepath.Join(t.TempDir(), "token")
+	done := make(chan error, 1)
+	go func() {
+		done <- client.MirrorToFile(ctx, "app/token", path, 0600)
+	}()
+
+	// waitFile waits until the file holds want, or is removed when want is
+	// empty
+	waitFile := func(want string) {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			data, err := os.ReadFile(path)
+			if (want == "" && os.IsNotExist(err)) || (err == nil && string(data) == want) {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("file never became %q", want)
+	}
+
+	waitFile("first")
+	info, err := os.Stat(path)
+	u.AssertNotError(err, "")
+	u.AssertEquals(os.FileMode(0600), info.Mode().Perm(), "")
+
+	close(put)
+	waitFile("second")
+
+	close(del)
+	waitFile("")
+
+	cancel()
+	u.AssertEquals(context.Canceled, <-done, "")
+}
+
+func TestWatchTemplate(t *testing.T) {
+	u := gounit.New(t)
+
+	var mu sync.Mutex
+	values := map[string]string{"db/host": "db.local", "db/port": "5432"}
+	index := uint64(10)
+	changed := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/v1/kv/")
+		if r.URL.Query().Has("index") {
+			// blocks until the test changes a value
+			select {
+			case <-changed:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+		w.Write(stubKVPair(key, values[key], index))
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	rendered := make(chan string, 10)
+	done := make(chan error, 1)
+	go func() {
+		done <- client.WatchTemplate(ctx, `{{key "db/host"}}:{{key "db/port"}}`, func(s string) {
+			rendered <- s
+		})
+	}()
+
+	next := func() string {
+		select {
+		case s := <-rendered:
+			return s
+		case <-time.After(5 * time.Second):
+			t.Fatal("not rendered")
+		}
+		return ""
+	}
+
+	u.AssertEquals("db.local:5432", next(), "initial")
+
+	mu.Lock()
+	values["db/port"] = "6432"
+	index = 11
+	mu.Unlock()
+	close(changed)
+
+	u.AssertEquals("db.local:6432", next(), "re-rendered")
+
+	cancel()
+	u.AssertEquals(context.Canceled, <-done, "")
+}
+
+func TestWatchTree(t *testing.T) {
+	u := gounit.New(t)
+
+	list := func(w http.ResponseWriter, index string, pairs ...*consulapi.KVPair) {
+		w.Header().Set("X-Consul-Index", index)
+		json.NewEncoder(w).Encode(pairs)
+	}
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("index") {
+		case "":
+			list(w, "10",
+				&consulapi.KVPair{Key: "app/host", Value: []byte("db.local"), ModifyIndex: 5},
+				&consulapi.KVPair{Key: "app/port", Value: []byte("80"), ModifyIndex: 6})
+		case "10":
+			list(w, "11",
+				&consulapi.KVPair{Key: "app/port", Value: []byte("80"), ModifyIndex: 6})
+		default:
+			<-r.Context().Done()
+		}
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	ch := client.WatchTree("app")
+
+	next := func() consulapi.KVPairs {
+		select {
+		case pairs := <-ch:
+			return pairs
+		case <-time.After(5 * time.Second):
+			t.Fatal("no pairs emitted")
+		}
+		return nil
+	}
+
+	u.AssertEquals(2, len(next()), "initial")
+	pairs := next()
+	u.AssertEquals(1, len(pairs), "after delete")
+	u.AssertEquals("app/port", pairs[0].Key, "")
+}
+
+func TestWatchTreeBatchedFlushOnFailure(t *testing.T) {
+	u := gounit.New(t)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("index") {
+		case "":
+			w.Header().Set("X-Consul-Index", "10")
+			json.NewEncoder(w).Encode(consulapi.KVPairs{{Key: "app/name", Value: []byte("v0"), ModifyIndex: 10}})
+		case "10":
+			w.Header().Set("X-Consul-Index", "11")
+			json.NewEncoder(w).Encode(consulapi.KVPairs{{Key: "app/name", Value: []byte("v1"), ModifyIndex: 11}})
+		default:
+			// the watch fails within the window
+			http.Error(w, "transient failure", http.StatusInternalServerError)
+		}
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := client.WatchTreeBatched(ctx, "app", time.Hour)
+	select {
+	case batch, ok := <-ch:
+		u.AssertEquals(true, ok, "pending batch delivered")
+		u.AssertEquals(1, len(batch), "")
+		u.AssertEquals("v1", string(batch[0].Value), "")
+	case <-time.After(5 * time.Second):
+		t.Fatal("pending batch dropped")
+	}
+	select {
+	case _, ok := <-ch:
+		u.AssertEquals(false, ok, "closed after the batch")
+	case <-time.After(5 * time.Second):
+		t.Fatal("not closed")
+	}
+}
+
+func TestWatchStructConcurrentReads(t *testing.T) {
+	u := gounit.New(t)
+
+	var mu sync.Mutex
+	index := uint64(10)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("index") != "" {
+			// every blocking query returns a change after a short wait
+			select {
+			case <-time.After(10 * time.Millisecond):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		mu.Lock()
+		index++
+		cur := index
+		mu.Unlock()
+		name := "v" + strconv.FormatUint(cur, 10)
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(cur, 10))
+		if r.URL.Query().Has("recurse") {
+			json.NewEncoder(w).Encode(consulapi.KVPairs{{Key: "app/name", Value: []byte(name), ModifyIndex: cur}})
+			return
+		}
+		w.Write(stubKVPair("app/name", name, cur))
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var smu sync.RWMutex
+	var s struct {
+		Name string
+	}
+	ch, err := client.WatchStructContext(ctx, "app", &s, &smu)
+	u.AssertNotError(err, "")
+
+	// reads holding the lock while reloads are swapped in, checked by -race
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for ctx.Err() == nil {
+			smu.RLock()
+			_ = s.Name
+			smu.RUnlock()
+		}
+	}()
+
+	for n := 0; n < 5; n++ {
+		select {
+		case <-ch:
+		case <-time.After(5 * time.Second):
+			t.Fatal("not reloaded")
+		}
+	}
+	cancel()
+	<-done
+}
+
+func TestWatchStructContextCancelReload(t *testing.T) {
+	u := gounit.New(t)
+
+	var mu sync.Mutex
+	changed := false
+	reloading := make(chan struct{}, 1)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		switch r.URL.Query().Get("index") {
+		case "":
+			if changed {
+				// the reload hangs until the watch is cancelled
+				mu.Unlock()
+				select {
+				case reloading <- struct{}{}:
+				default:
+				}
+				<-r.Context().Done()
+				return
+			}
+		case "10":
+			changed = true
+		default:
+			mu.Unlock()
+			<-r.Context().Done()
+			return
+		}
+		index := uint64(10)
+		if changed {
+			index = 11
+		}
+		mu.Unlock()
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+		if r.URL.Query().Has("recurse") {
+			json.NewEncoder(w).Encode(consulapi.KVPairs{{Key: "app/name", Value: []byte("v0"), ModifyIndex: 10}})
+			return
+		}
+		w.Write(stubKVPair("app/name", "v0", 10))
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var smu sync.RWMutex
+	var s struct {
+		Name string
+	}
+	ch, err := client.WatchStructContext(ctx, "app", &s, &smu)
+	u.AssertNotError(err, "")
+
+	select {
+	case <-reloading:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reload")
+	}
+	cancel()
+
+	select {
+	case _, ok := <-ch:
+		u.AssertEquals(false, ok, "closed without a reload signal")
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch not stopped")
+	}
+	smu.RLock()
+	defer smu.RUnlock()
+	u.AssertEquals("v0", s.Name, "interrupted reload left the struct unchanged")
+}
+
+func TestWatchStructContext(t *testing.T) {
+	u := gounit.New(t)
+
+	var mu sync.Mutex
+	name, index := "v0", uint64(10)
+	put := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("index") {
+		case "":
+		case "10":
+			<-put
+		default:
+			<-r.Context().Done()
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+		if r.URL.Query().Has("recurse") {
+			json.NewEncoder(w).Encode(consulapi.KVPairs{{Key: "app/name", Value: []byte(name), ModifyIndex: index}})
+			return
+		}
+		w.Write(stubKVPair("app/name", name, index))
+	})
+
+	client, srv, err := testutil.NewStubClient(handler)
+	u.AssertNotError(err, "")
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var smu sync.RWMutex
+	var s struct {
+		Name string
+	}
+	ch, err := client.WatchStructContext(ctx, "app", &s, &smu)
+	u.AssertNotError(err, "")
+	u.AssertEquals("v0", s.Name, "initial load")
+
+	mu.Lock()
+	name, index = "v1", 11
+	mu.Unlock()
+	close(put)
+
+	select {
+	case <-ch:
+		smu.RLock()
+		u.AssertEquals("v1", s.Name, "reloaded")
+		smu.RUnlock()
+	case <-time.After(5 * time.Second):
+		t.Fatal("not reloaded")
+	}
+
+	cancel()
+	select {
+	case _, ok := <-ch:
+		u.AssertEquals(false, ok, "closed on cancel")
+	case <-time.After(5 * time.Second):
+		t.Fatal("watch not stopped")
+	}
+}
@@ -1,6 +1,9 @@
 package testutil
 
 import (
+	"net/http"
+	"net/http/httptest"
+
 	consulapi "github.com/hashicorp/consul/api"
 	"github.com/l-vitaly/consul"
 )
@@ -9,10 +12,65 @@ func defaultServerConfig() *consulapi.Config {
 	return consulapi.DefaultConfig()
 }
 
-func NewClient() (consul.Client, error) {
+func NewClient(opts ...consul.Option) (consul.Client, error) {
 	c, err := consulapi.NewClient(defaultServerConfig())
 	if err != nil {
 		return nil, err
 	}
-	return consul.NewClientWithConsulClient(c), nil
+	return consul.NewClientWithConsulClient(c, opts...), nil
+}
+
+// NewStubClient returns a client talking to the given handler instead of a
+// consul agent, the caller must close the returned server
+func NewStubClient(handler http.Handler, opts ...consul.Option) (consul.Client, *httptest.Server, error) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// headers always sent by an agent, query meta is not parsed without them
+		w.Header().Set("X-Consul-LastContact", "0")
+		w.Header().Set("X-Consul-KnownLeader", "true")
+		handler.ServeHTTP(w, r)
+	}))
+
+	config := consulapi.DefaultConfig()
+	config.Address = srv.URL
+
+	c, err := consulapi.NewClient(config)
+	if err != nil {
+		srv.Close()
+		return nil, nil, err
+	}
+	return consul.NewClientWithConsulClient(c, opts...), srv, nil
+}
+
+// Seed puts the kv pairs and registers the services with the test agent
+func Seed(c consul.Client, kv map[string]string, services []consul.ServiceOptions) error {
+	if len(kv) > 0 {
+		if _, err := c.PutMulti(kv); err != nil {
+			return err
+		}
+	}
+	for _, s := range services {
+		if err := c.RegisterServiceWithOptions(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Cleanup removes the kv pairs and services added by Seed
+func Cleanup(c consul.Client, kv map[string]string, services []consul.ServiceOptions) error {
+	for k := range kv {
+		if _, err := c.Delete(k); err != nil {
+			return err
+		}
+	}
+	for _, s := range services {
+		id := s.ID
+		if id == "" {
+			id = s.Name
+		}
+		if err := c.DeRegisterService(id); err != nil {
+			return err
+		}
+	}
+	return nil
 }
@@ -0,0 +1,692 @@
+package consul
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// blockingQuery calls query with the options waiting for the next index,
+// starting after lastIndex, and calls changed each time the returned index
+// moves, until ctx is done or query fails. key identifies the watch for
+// the watch index hook.
+func (c *client) blockingQuery(ctx context.Context, key string, lastIndex uint64, query func(q *consulapi.QueryOptions) (uint64, error), changed func()) error {
+	for {
+		index, err := c.runBlockingQuery(ctx, lastIndex, query)
+		if err == errQueryLifetime {
+			// re-establish a query which outlived the max lifetime
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if c.onWatchIndex != nil {
+			c.onWatchIndex(key, lastIndex, index)
+		}
+
+		index = nextWaitIndex(lastIndex, index)
+		if index == 0 {
+			// index went backwards, re-run the query without blocking
+			lastIndex = 0
+			continue
+		}
+		if index == lastIndex {
+			// wait time elapsed without any change
+			continue
+		}
+		lastIndex = index
+		changed()
+	}
+}
+
+var errQueryLifetime = errors.New("blocking query reached max lifetime")
+
+// runBlockingQuery runs a single blocking query, bounded by the max
+// lifetime of watch queries when set so a query stuck on a dead connection
+// is torn down
+func (c *client) runBlockingQuery(ctx context.Context, waitIndex uint64, query func(q *consulapi.QueryOptions) (uint64, error)) (uint64, error) {
+	qctx := ctx
+	if c.watchMaxLifetime > 0 {
+		var cancel context.CancelFunc
+		qctx, cancel = context.WithTimeout(ctx, c.watchMaxLifetime)
+		defer cancel()
+	}
+
+	q := &consulapi.QueryOptions{WaitIndex: waitIndex, RequireConsistent: c.consistentWatches}
+	index, err := query(q.WithContext(qctx))
+	if err != nil {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		if qctx.Err() != nil {
+			return 0, errQueryLifetime
+		}
+		return 0, err
+	}
+	return index, nil
+}
+
+// nextWaitIndex returns the index for the next blocking query following the
+// consul recommendations: it is reset to 0 when the returned index goes
+// backwards (e.g. after a snapshot restore), so the watch never waits for an
+// index the server will not reach again, and otherwise is never less than 1.
+func nextWaitIndex(lastIndex, index uint64) uint64 {
+	if index < lastIndex {
+		return 0
+	}
+	if index < 1 {
+		return 1
+	}
+	return index
+}
+
+// prefixIndex returns the index of the KVPairs under prefix, for a watch of
+// prefix to start from without reporting them as a change
+func (c *client) prefixIndex(ctx context.Context, prefix string) (uint64, error) {
+	q := &consulapi.QueryOptions{RequireConsistent: c.consistentWatches}
+	_, meta, err := c.kv.List(prefix, q.WithContext(ctx))
+	if err != nil {
+		return 0, leaderError(err)
+	}
+	return meta.LastIndex, nil
+}
+
+// watchPrefix calls fn with the KVPairs under prefix whenever they change,
+// starting after lastIndex, until ctx is done or a query fails
+func (c *client) watchPrefix(ctx context.Context, prefix string, lastIndex uint64, fn func(consulapi.KVPairs)) error {
+	var pairs consulapi.KVPairs
+	return c.blockingQuery(ctx, prefix, lastIndex, func(q *consulapi.QueryOptions) (uint64, error) {
+		var meta *consulapi.QueryMeta
+		var err error
+		pairs, meta, err = c.kv.List(prefix, q)
+		if err != nil {
+			return 0, err
+		}
+		return meta.LastIndex, nil
+	}, func() {
+		fn(pairs)
+	})
+}
+
+// WatchServices emits the passing instances of service with the tag on
+// start and whenever they change, the channel is closed when ctx is done or
+// the watch fails
+func (c *client) WatchServices(ctx context.Context, service string, tag string) <-chan []*consulapi.ServiceEntry {
+	return c.WatchServicesFiltered(ctx, service, tag, "")
+}
+
+// WatchServicesFiltered is WatchServices with a filter expression applied
+// by consul, only changes of the matching instances are emitted
+func (c *client) WatchServicesFiltered(ctx context.Context, service string, tag string, filter string) <-chan []*consulapi.ServiceEntry {
+	ch := make(chan []*consulapi.ServiceEntry)
+	go func() {
+		defer close(ch)
+
+		var addrs []*consulapi.ServiceEntry
+		var lastSig string
+		var emitted bool
+		c.blockingQuery(ctx, service, 0, func(q *consulapi.QueryOptions) (uint64, error) {
+			q.Filter = filter
+			var meta *consulapi.QueryMeta
+			var err error
+			addrs, meta, err = c.health.Service(service, tag, true, q)
+			if err != nil {
+				return 0, err
+			}
+			return meta.LastIndex, nil
+		}, func() {
+			// the index moves on changes of instances not matching the filter
+			// no instances sign as "" too and are emitted on start
+			sig := servicesSignature(addrs)
+			if emitted && sig == lastSig {
+				return
+			}
+			lastSig, emitted = sig, true
+			select {
+			case ch <- addrs:
+			case <-ctx.Done():
+			}
+		})
+	}()
+	return ch
+}
+
+// WatchServiceTags emits the tags of each instance of service by instance
+// ID, regardless of their health, on start and whenever they change, e.g.
+// on a canary promotion re-tagging instances. The channel is closed when
+// ctx is done or the watch fails.
+func (c *client) WatchServiceTags(ctx context.Context, service string) <-chan map[string][]string {
+	ch := make(chan map[string][]string)
+	go func() {
+		defer close(ch)
+
+		var addrs []*consulapi.ServiceEntry
+		var last map[string][]string
+		c.blockingQuery(ctx, service, 0, func(q *consulapi.QueryOptions) (uint64, error) {
+			var meta *consulapi.QueryMeta
+			var err error
+			addrs, meta, err = c.health.Service(service, "", false, q)
+			if err != nil {
+				return 0, err
+			}
+			return meta.LastIndex, nil
+		}, func() {
+			tags := make(map[string][]string, len(addrs))
+			for _, addr := range addrs {
+				tags[addr.Service.ID] = addr.Service.Tags
+			}
+			// the index also moves on health changes
+			if last != nil && reflect.DeepEqual(tags, last) {
+				return
+			}
+			last = tags
+			select {
+			case ch <- tags:
+			case <-ctx.Done():
+			}
+		})
+	}()
+	return ch
+}
+
+// servicesSignature identifies a set of instances and their registrations
+func servicesSignature(addrs []*consulapi.ServiceEntry) string {
+	ids := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		ids = append(ids, fmt.Sprintf("%s/%s/%d", addr.Node.Node, addr.Service.ID, addr.Service.ModifyIndex))
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
+
+// WatchStructMap watches parent and loads a struct created by factory for
+// each immediate child prefix, the map keyed by child name is emitted on
+// start and on every change. A change failing to load is skipped. The
+// channel is closed when ctx is done or the watch fails.
+func (c *client) WatchStructMap(ctx context.Context, parent string, factory func() interface{}) (<-chan map[string]interface{}, error) {
+	// without the slash siblings such as parent-old are listed too
+	prefix := parent + "/"
+	q := &consulapi.QueryOptions{RequireConsistent: c.consistentWatches}
+	pairs, meta, err := c.kv.List(prefix, q.WithContext(ctx))
+	if err != nil {
+		return nil, leaderError(err)
+	}
+	structs, err := c.loadStructMap(ctx, parent, pairs, factory)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan map[string]interface{}, 1)
+	ch <- structs
+	go func() {
+		defer close(ch)
+		c.watchPrefix(ctx, prefix, meta.LastIndex, func(pairs consulapi.KVPairs) {
+			structs, err := c.loadStructMap(ctx, parent, pairs, factory)
+			if err != nil {
+				return
+			}
+			select {
+			case ch <- structs:
+			case <-ctx.Done():
+			}
+		})
+	}()
+	return ch, nil
+}
+
+func (c *client) loadStructMap(ctx context.Context, parent string, pairs consulapi.KVPairs, factory func() interface{}) (map[string]interface{}, error) {
+	res := make(map[string]interface{})
+	for _, name := range childPrefixes(parent, pairs) {
+		i := factory()
+		if err := c.LoadStructContext(ctx, parent+"/"+name, i); err != nil {
+			return nil, err
+		}
+		res[name] = i
+	}
+	return res, nil
+}
+
+// childPrefixes returns the names of the immediate child prefixes of parent,
+// keys directly under parent are not prefixes and are ignored
+func childPrefixes(parent string, pairs consulapi.KVPairs) []string {
+	seen := make(map[string]bool)
+	var res []string
+	for _, p := range pairs {
+		rest, ok := strings.CutPrefix(p.Key, parent+"/")
+		if !ok {
+			continue
+		}
+		i := strings.Index(rest, "/")
+		if i <= 0 {
+			continue
+		}
+		name := rest[:i]
+		if !seen[name] {
+			seen[name] = true
+			res = append(res, name)
+		}
+	}
+	return res
+}
+
+// WatchStruct loads the struct under parent into i and reloads it whenever
+// a key under parent changes, signaling on the returned channel after each
+// reload. Each reload is loaded into a new value swapped into i while
+// holding mu, reads of i must hold mu too, e.g. the read lock of the
+// sync.RWMutex passed as mu. A reload failing to load leaves i unchanged.
+func (c *client) WatchStruct(parent string, i interface{}, mu sync.Locker) (<-chan struct{}, error) {
+	return c.watchStruct(context.Background(), parent, i, mu, 0)
+}
+
+// WatchStructContext is WatchStruct stopped when ctx is done, the channel
+// is closed then. A reload interrupted by ctx leaves i unchanged.
+func (c *client) WatchStructContext(ctx context.Context, parent string, i interface{}, mu sync.Locker) (<-chan struct{}, error) {
+	return c.watchStruct(ctx, parent, i, mu, 0)
+}
+
+// WatchStructDebounced is WatchStruct reloading only once no key under
+// parent changed for window, so a burst of changes causes a single reload
+func (c *client) WatchStructDebounced(parent string, i interface{}, mu sync.Locker, window time.Duration) (<-chan struct{}, error) {
+	return c.watchStruct(context.Background(), parent, i, mu, window)
+}
+
+// WatchStructDebouncedContext is WatchStructDebounced stopped when ctx is
+// done, the channel is closed then
+func (c *client) WatchStructDebouncedContext(ctx context.Context, parent string, i interface{}, mu sync.Locker, window time.Duration) (<-chan struct{}, error) {
+	return c.watchStruct(ctx, parent, i, mu, window)
+}
+
+func (c *client) watchStruct(ctx context.Context, parent string, i interface{}, mu sync.Locker, window time.Duration) (<-chan struct{}, error) {
+	if mu == nil {
+		return nil, errors.New("watch struct: nil locker")
+	}
+	if err := c.reloadStruct(ctx, parent, i, mu); err != nil {
+		return nil, err
+	}
+	_, meta, err := c.kv.List(parent, (&consulapi.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return nil, leaderError(err)
+	}
+
+	changes := make(chan struct{}, 1)
+	go func() {
+		defer close(changes)
+		c.watchPrefix(ctx, parent, meta.LastIndex, func(consulapi.KVPairs) {
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		})
+	}()
+
+	ch := make(chan struct{}, 1)
+	go func() {
+		defer close(ch)
+		for range debounce(changes, window) {
+			if err := c.reloadStruct(ctx, parent, i, mu); err != nil {
+				continue
+			}
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return ch, nil
+}
+
+// reloadStruct loads the struct under parent into a new value and only then
+// replaces i holding mu, so a failed load leaves i untouched and readers
+// holding mu never see a partial write
+func (c *client) reloadStruct(ctx context.Context, parent string, i interface{}, mu sync.Locker) error {
+	target := reflect.ValueOf(i)
+	if target.Kind() != reflect.Ptr || target.IsNil() {
+		return c.LoadStructContext(ctx, parent, i)
+	}
+	fresh := reflect.New(target.Elem().Type())
+	if err := c.LoadStructContext(ctx, parent, fresh.Interface()); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		// the watch was stopped during the load
+		return err
+	}
+	mu.Lock()
+	target.Elem().Set(fresh.Elem())
+	mu.Unlock()
+	return nil
+}
+
+// debounce forwards a signal from in once no other signal arrived for
+// window, the returned channel is closed after in is closed
+func debounce(in <-chan struct{}, window time.Duration) <-chan struct{} {
+	if window <= 0 {
+		return in
+	}
+
+	out := make(chan struct{})
+	go func() {
+		defer close(out)
+
+		timer := time.NewTimer(window)
+		timer.Stop()
+		pending := false
+		for {
+			select {
+			case _, ok := <-in:
+				if !ok {
+					if pending {
+						out <- struct{}{}
+					}
+					return
+				}
+				if pending && !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(window)
+				pending = true
+			case <-timer.C:
+				pending = false
+				out <- struct{}{}
+			}
+		}
+	}()
+	return out
+}
+
+// WatchTree emits the KVPairs under prefix on start and whenever any of
+// them is created, modified or deleted, the channel is closed when the
+// watch fails
+func (c *client) WatchTree(prefix string) chan consulapi.KVPairs {
+	ch := make(chan consulapi.KVPairs)
+	go func() {
+		defer close(ch)
+		c.watchPrefix(context.Background(), prefix, 0, func(pairs consulapi.KVPairs) {
+			ch <- pairs
+		})
+	}()
+	return ch
+}
+
+// WatchTreeContext is WatchTree terminated when ctx is done, the channel
+// is closed then
+func (c *client) WatchTreeContext(ctx context.Context, prefix string) <-chan consulapi.KVPairs {
+	ch := make(chan consulapi.KVPairs)
+	go func() {
+		defer close(ch)
+		c.watchPrefix(ctx, prefix, 0, func(pairs consulapi.KVPairs) {
+			select {
+			case ch <- pairs:
+			case <-ctx.Done():
+			}
+		})
+	}()
+	return ch
+}
+
+// WatchTreeBatched watches the KVPairs under prefix and delivers the pairs
+// changed within window after a first change as a single batch, so a bulk
+// update causes a single reload. Deleted keys are delivered as pairs with
+// only the Key set and a zero ModifyIndex. The channel is closed when ctx
+// is done or the watch fails, after the pending batch in the latter case.
+func (c *client) WatchTreeBatched(ctx context.Context, prefix string, window time.Duration) <-chan []*consulapi.KVPair {
+	changes := make(chan []*consulapi.KVPair)
+	go func() {
+		defer close(changes)
+
+		pairs, meta, err := c.kv.List(prefix, (&consulapi.QueryOptions{}).WithContext(ctx))
+		if err != nil {
+			return
+		}
+		_, last := changedPairs(nil, pairs)
+		c.watchPrefix(ctx, prefix, meta.LastIndex, func(pairs consulapi.KVPairs) {
+			var changed []*consulapi.KVPair
+			changed, last = changedPairs(last, pairs)
+			if len(changed) == 0 {
+				return
+			}
+			select {
+			case changes <- changed:
+			case <-ctx.Done():
+			}
+		})
+	}()
+
+	ch := make(chan []*consulapi.KVPair)
+	go func() {
+		defer close(ch)
+
+		batch := make(map[string]*consulapi.KVPair)
+		var timer <-chan time.Time
+		for {
+			select {
+			case changed, ok := <-changes:
+				if !ok {
+					// the watch failed, deliver the changes already seen
+					if len(batch) > 0 && ctx.Err() == nil {
+						select {
+						case ch <- sortedPairs(batch):
+						case <-ctx.Done():
+						}
+					}
+					return
+				}
+				if timer == nil {
+					timer = time.After(window)
+				}
+				for _, p := range changed {
+					batch[p.Key] = p
+				}
+			case <-timer:
+				timer = nil
+				select {
+				case ch <- sortedPairs(batch):
+				case <-ctx.Done():
+					return
+				}
+				batch = make(map[string]*consulapi.KVPair)
+			}
+		}
+	}()
+	return ch
+}
+
+// changedPairs returns the pairs added or modified since last, deleted keys
+// as pairs with only the Key set, and the pairs by key to compare the next
+// ones with
+func changedPairs(last map[string]*consulapi.KVPair, pairs consulapi.KVPairs) ([]*consulapi.KVPair, map[string]*consulapi.KVPair) {
+	next := make(map[string]*consulapi.KVPair, len(pairs))
+	var changed []*consulapi.KVPair
+	for _, p := range pairs {
+		next[p.Key] = p
+		if old, ok := last[p.Key]; !ok || old.ModifyIndex != p.ModifyIndex {
+			changed = append(changed, p)
+		}
+	}
+	for k := range last {
+		if _, ok := next[k]; !ok {
+			changed = append(changed, &consulapi.KVPair{Key: k})
+		}
+	}
+	return changed, next
+}
+
+func sortedPairs(pairs map[string]*consulapi.KVPair) []*consulapi.KVPair {
+	res := make([]*consulapi.KVPair, 0, len(pairs))
+	for _, p := range pairs {
+		res = append(res, p)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Key < res[j].Key
+	})
+	return res
+}
+
+// TreeDiff the keys of a watched prefix added, modified and deleted by a
+// change, each sorted by key
+type TreeDiff struct {
+	Added    []*consulapi.KVPair
+	Modified []*consulapi.KVPair
+	Deleted  []string
+}
+
+// WatchTreeDiff returns the KVPairs under prefix and a channel of the
+// differences of each following change, for caches applying minimal
+// updates to a large tree. The channel is closed when ctx is done or the
+// watch fails.
+func (c *client) WatchTreeDiff(ctx context.Context, prefix string) (consulapi.KVPairs, <-chan TreeDiff, error) {
+	initial, meta, err := c.kv.List(prefix, (&consulapi.QueryOptions{}).WithContext(ctx))
+	if err != nil {
+		return nil, nil, leaderError(err)
+	}
+
+	ch := make(chan TreeDiff)
+	go func() {
+		defer close(ch)
+
+		_, last := changedPairs(nil, initial)
+		c.watchPrefix(ctx, prefix, meta.LastIndex, func(pairs consulapi.KVPairs) {
+			var diff TreeDiff
+			diff, last = treeDiff(last, pairs)
+			if len(diff.Added)+len(diff.Modified)+len(diff.Deleted) == 0 {
+				return
+			}
+			select {
+			case ch <- diff:
+			case <-ctx.Done():
+			}
+		})
+	}()
+	return initial, ch, nil
+}
+
+// treeDiff returns the difference from last to pairs and the pairs by key
+// to compare the next ones with
+func treeDiff(last map[string]*consulapi.KVPair, pairs consulapi.KVPairs) (TreeDiff, map[string]*consulapi.KVPair) {
+	changed, next := changedPairs(last, pairs)
+	sort.Slice(changed, func(i, j int) bool {
+		return changed[i].Key < changed[j].Key
+	})
+
+	var diff TreeDiff
+	for _, p := range changed {
+		if _, ok := next[p.Key]; !ok {
+			diff.Deleted = append(diff.Deleted, p.Key)
+		} else if _, ok := last[p.Key]; ok {
+			diff.Modified = append(diff.Modified, p)
+		} else {
+			diff.Added = append(diff.Added, p)
+		}
+	}
+	return diff, next
+}
+
+// WatchTreeOptions options for WatchTreeEvents
+type WatchTreeOptions struct {
+	// DetectRenames reports a key deleted and a key created with the same
+	// value within a single change as one rename instead of a delete and a
+	// create. It is a heuristic: two unrelated keys sharing a value are
+	// reported as a rename too. When several created keys match a deleted
+	// one the first in key order is picked.
+	DetectRenames bool
+}
+
+// Renamed a key renamed from Old to New
+type Renamed struct {
+	Old string
+	New string
+}
+
+// TreeEvent a change of a key of a watched prefix, KV is nil when the key
+// was deleted. Renamed is set when the change is a rename, Key and KV are
+// then those of the new key.
+type TreeEvent struct {
+	Key     string
+	KV      *consulapi.KVPair
+	Renamed *Renamed
+}
+
+// WatchTreeEvents watches the KVPairs under prefix and emits an event for
+// each key created, modified or deleted, the channel is closed when ctx is
+// done or the watch fails
+func (c *client) WatchTreeEvents(ctx context.Context, prefix string, opts WatchTreeOptions) <-chan TreeEvent {
+	ch := make(chan TreeEvent)
+	go func() {
+		defer close(ch)
+
+		pairs, meta, err := c.kv.List(prefix, (&consulapi.QueryOptions{}).WithContext(ctx))
+		if err != nil {
+			return
+		}
+		_, last := changedPairs(nil, pairs)
+		c.watchPrefix(ctx, prefix, meta.LastIndex, func(pairs consulapi.KVPairs) {
+			var events []TreeEvent
+			events, last = treeEvents(last, pairs, opts.DetectRenames)
+			for _, e := range events {
+				select {
+				case ch <- e:
+				case <-ctx.Done():
+					return
+				}
+			}
+		})
+	}()
+	return ch
+}
+
+// treeEvents returns the events of the change from last to pairs ordered by
+// key and the pairs by key to compare the next ones with
+func treeEvents(last map[string]*consulapi.KVPair, pairs consulapi.KVPairs, detectRenames bool) ([]TreeEvent, map[string]*consulapi.KVPair) {
+	changed, next := changedPairs(last, pairs)
+	sort.Slice(changed, func(i, j int) bool {
+		return changed[i].Key < changed[j].Key
+	})
+
+	var events []TreeEvent
+	renamed := make(map[string]bool)
+	if detectRenames {
+		for _, deleted := range changed {
+			if deleted.ModifyIndex != 0 {
+				continue
+			}
+			for _, created := range changed {
+				if _, existed := last[created.Key]; existed || renamed[created.Key] {
+					continue
+				}
+				if bytes.Equal(last[deleted.Key].Value, created.Value) {
+					renamed[deleted.Key] = true
+					renamed[created.Key] = true
+					events = append(events, TreeEvent{
+						Key:     created.Key,
+						KV:      created,
+						Renamed: &Renamed{Old: deleted.Key, New: created.Key},
+					})
+					break
+				}
+			}
+		}
+	}
+
+	for _, p := range changed {
+		if renamed[p.Key] {
+			continue
+		}
+		if p.ModifyIndex == 0 {
+			events = append(events, TreeEvent{Key: p.Key})
+		} else {
+			events = append(events, TreeEvent{Key: p.Key, KV: p})
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Key < events[j].Key
+	})
+	return events, next
+}
@@ -0,0 +1,50 @@
+package consul
+
+import (
+	"testing"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/l-vitaly/gounit"
+)
+
+func TestDebounceCoalescesBurst(t *testing.T) {
+	u := gounit.New(t)
+
+	in := make(chan struct{})
+	out := debounce(in, 50*time.Millisecond)
+
+	for i := 0; i < 5; i++ {
+		in <- struct{}{}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case <-out:
+	case <-time.After(time.Second):
+		t.Fatal("no signal after the burst settled")
+	}
+
+	select {
+	case <-out:
+		t.Fatal("burst signaled more than once")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	close(in)
+	_, ok := <-out
+	u.AssertEquals(false, ok, "closed with input")
+}
+
+func TestChildPrefixesSkipsSiblings(t *testing.T) {
+	u := gounit.New(t)
+
+	pairs := consulapi.KVPairs{
+		{Key: "plugins/auth/enabled"},
+		{Key: "plugins/auth/name"},
+		{Key: "plugins/cache/enabled"},
+		{Key: "plugins/version"},
+		{Key: "plugins-old/x/y"},
+	}
+	u.AssertEquals([]string{"auth", "cache"}, childPrefixes("plugins", pairs), "")
+}